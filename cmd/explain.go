@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"signalfx-prometheus-exporter/serve"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	// cli flags
+	observabilityURL   string
+	bearerTokenFile    string
+	basicAuthUsername  string
+	basicAuthPassFile  string
+	caFile             string
+	insecureSkipVerify bool
+)
+
+var explainCmd = &cobra.Command{
+	Use:   "explain <selector>",
+	Short: "Show the flow, template and SignalFx time series an exported series comes from",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := lineageClient()
+		if err != nil {
+			return err
+		}
+		lineage, err := fetchLineage(client, observabilityURL, args[0])
+		if err != nil {
+			return err
+		}
+		if len(lineage) == 0 {
+			fmt.Fprintf(os.Stderr, "No series matches %s\n", args[0])
+		}
+		for _, series := range lineage {
+			fmt.Printf("%s%s (%s)\n", series.Name, formatLabels(series.Labels), series.Type)
+			for _, source := range series.Sources {
+				fmt.Printf("  flow=%s stream=%s template=%d tsid=%s\n", source.Flow, source.Stream, source.TemplateIndex, source.TSID)
+				fmt.Printf("    dimensions: %s\n", formatLabels(source.Dimensions))
+			}
+		}
+		return nil
+	},
+}
+
+// authTransport authenticates every request against the observability server
+type authTransport struct {
+	next     http.RoundTripper
+	token    string
+	username string
+	password string
+}
+
+func (at *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if at.token != "" {
+		req.Header.Set("Authorization", "Bearer "+at.token)
+	} else if at.username != "" {
+		req.SetBasicAuth(at.username, at.password)
+	}
+	return at.next.RoundTrip(req)
+}
+
+func readSecretFile(file string) (string, error) {
+	secret, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read %s - %+s", file, err)
+	}
+	return strings.TrimSpace(string(secret)), nil
+}
+
+// lineageClient builds the http client from the authentication and TLS flags
+func lineageClient() (*http.Client, error) {
+	if bearerTokenFile != "" && basicAuthUsername != "" {
+		return nil, fmt.Errorf("Only one of --bearer-token-file and --username can be set")
+	}
+	if basicAuthPassFile != "" && basicAuthUsername == "" {
+		return nil, fmt.Errorf("--password-file requires --username")
+	}
+	auth := &authTransport{username: basicAuthUsername}
+	var err error
+	if bearerTokenFile != "" {
+		if auth.token, err = readSecretFile(bearerTokenFile); err != nil {
+			return nil, err
+		}
+	}
+	if basicAuthPassFile != "" {
+		if auth.password, err = readSecretFile(basicAuthPassFile); err != nil {
+			return nil, err
+		}
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if caFile != "" {
+		caBytes, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read %s - %+s", caFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("No certificates found in CA file %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	auth.next = transport
+	return &http.Client{Timeout: 10 * time.Second, Transport: auth}, nil
+}
+
+func fetchLineage(client *http.Client, baseURL string, selector string) ([]serve.SeriesLineage, error) {
+	resp, err := client.Get(fmt.Sprintf("%s/api/v1/lineage?%s", strings.TrimSuffix(baseURL, "/"), url.Values{"match[]": {selector}}.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Lineage request failed with status %s", resp.Status)
+	}
+	var response struct {
+		Data []serve.SeriesLineage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, labels[name])
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+func init() {
+	rootCmd.AddCommand(explainCmd)
+	explainCmd.Flags().StringVarP(&observabilityURL, "url", "u", "http://localhost:9090", "url of the observability server of the exporter")
+	explainCmd.Flags().StringVar(&bearerTokenFile, "bearer-token-file", "", "file with the bearer token to authenticate against the observability server")
+	explainCmd.Flags().StringVar(&basicAuthUsername, "username", "", "basic auth username to authenticate against the observability server")
+	explainCmd.Flags().StringVar(&basicAuthPassFile, "password-file", "", "file with the basic auth password of --username")
+	explainCmd.Flags().StringVar(&caFile, "ca-file", "", "CA certificate file to verify the TLS certificate of the observability server")
+	explainCmd.Flags().BoolVar(&insecureSkipVerify, "insecure-skip-verify", false, "skip verifying the TLS certificate of the observability server")
+}
@@ -8,16 +8,26 @@ import (
 
 var (
 	// cli flags
-	listenPort        int
-	observabilityPort int
-	configFile        string
+	listenPort                 int
+	listenAddress              string
+	observabilityPort          int
+	observabilityListenAddress string
+	configFile                 string
+	webConfigFile              string
+	observabilityWebConfigFile string
+	adminAPI                   bool
 )
 
 var serveCmd = &cobra.Command{
 	Use:   "serve",
 	Short: "Listen for signalfx scrape requests",
 	Run: func(cmd *cobra.Command, args []string) {
-		serve.CollectoAndServe(configFile, listenPort, observabilityPort, cmd.Context())
+		serve.CollectoAndServe(
+			configFile,
+			serve.Listener{Address: listenAddress, Port: listenPort, WebConfigFile: webConfigFile},
+			serve.Listener{Address: observabilityListenAddress, Port: observabilityPort, WebConfigFile: observabilityWebConfigFile, AdminAPI: adminAPI},
+			cmd.Context(),
+		)
 	},
 }
 
@@ -26,4 +36,9 @@ func init() {
 	serveCmd.Flags().IntVarP(&listenPort, "port", "l", 9091, "listen port for incoming scrape requests")
 	serveCmd.Flags().StringVarP(&configFile, "config", "c", "/config/config.yml", "flow config file")
 	serveCmd.Flags().IntVarP(&observabilityPort, "observability-port", "p", 9090, "port for expoerter self observability")
+	serveCmd.Flags().StringVar(&listenAddress, "listen-address", "", "address to bind the scrape server to, all interfaces if empty")
+	serveCmd.Flags().StringVar(&observabilityListenAddress, "observability-listen-address", "", "address to bind the observability server to, all interfaces if empty")
+	serveCmd.Flags().StringVar(&webConfigFile, "web-config", "", "web config file with TLS and authentication settings of the scrape server")
+	serveCmd.Flags().StringVar(&observabilityWebConfigFile, "observability-web-config", "", "web config file with TLS and authentication settings of the observability server")
+	serveCmd.Flags().BoolVar(&adminAPI, "enable-admin-api", false, "serve the admin API to pause, resume and restart flows on the observability server, requires authentication")
 }
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// AutoType derives the Prometheus type of a template from the SignalFx
+	// metadata of each time series
+	AutoType = "auto"
+
+	// SignalFx internal properties describing the metric type and rollup
+	SfMetricTypeProperty = "sf_metricType"
+	SfTypeProperty       = "sf_type"
+	SfRollupProperty     = "sf_rollup"
+)
+
+var (
+	metricTypes = map[string]bool{
+		"gauge": true, "counter": true, "histogram": true,
+		"summary": true, "stateset": true, "info": true, AutoType: true,
+	}
+
+	// rollups accumulating deltas become counters, all others report a
+	// current value
+	rollupTypes = map[string]string{
+		"sum":     "counter",
+		"delta":   "counter",
+		"latest":  "gauge",
+		"average": "gauge",
+		"min":     "gauge",
+		"max":     "gauge",
+		"count":   "gauge",
+		"rate":    "gauge",
+		"lag":     "gauge",
+	}
+
+	sfMetricTypes = map[string]string{
+		"gauge":              "gauge",
+		"counter":            "counter",
+		"cumulative_counter": "counter",
+	}
+)
+
+func validateMetricType(metricType string) error {
+	if metricType == "" {
+		return fmt.Errorf("Metric templates require a type")
+	}
+	if !metricTypes[metricType] {
+		return fmt.Errorf("Unknown metric type %s", metricType)
+	}
+	return nil
+}
+
+// MetricType returns the Prometheus type of a datapoint processed by the
+// template. Templates with the auto type derive it from the rollup of the
+// time series, or from its SignalFx metric type when no rollup is known.
+func (pm *PrometheusMetric) MetricType(internalProps map[string]interface{}) (string, error) {
+	if pm.Type != AutoType {
+		return pm.Type, nil
+	}
+	if rollup, ok := internalProps[SfRollupProperty].(string); ok {
+		if metricType, ok := rollupTypes[strings.ToLower(rollup)]; ok {
+			return metricType, nil
+		}
+	}
+	for _, property := range []string{SfMetricTypeProperty, SfTypeProperty} {
+		if sfType, ok := internalProps[property].(string); ok {
+			if metricType, ok := sfMetricTypes[strings.ToLower(sfType)]; ok {
+				return metricType, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("Can't derive a metric type from the SignalFx metadata")
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// familyType returns the type of the metric family a template exposes its
+// series as, info metrics are gauges
+func familyType(metricType string) string {
+	if metricType == "info" {
+		return "gauge"
+	}
+	return metricType
+}
+
+// renamesMetric reports whether relabeling may change the metric name
+func renamesMetric(configs []RelabelConfig) bool {
+	for _, rc := range configs {
+		switch rc.Action {
+		case RelabelReplace, RelabelHashMod:
+			if rc.TargetLabel == MetricNameLabel || strings.Contains(rc.TargetLabel, "$") {
+				return true
+			}
+		case RelabelLabelMap:
+			return true
+		}
+	}
+	return false
+}
+
+// staticName returns the metric name of a template whose name doesn't depend
+// on the datapoint, with the suffixes and naming rules applied at runtime
+func (pm *PrometheusMetric) staticName(fp *FlowProgram, naming Naming) (string, bool) {
+	if pm.Name == "" || strings.Contains(pm.Name, "{{") || pm.Type == AutoType {
+		return "", false
+	}
+	if renamesMetric(pm.RelabelConfigs) || renamesMetric(fp.RelabelConfigs) {
+		return "", false
+	}
+	name := pm.ApplyUnitSuffix(pm.Name)
+	if pm.Type == "info" && !strings.HasSuffix(name, "_info") {
+		name = name + "_info"
+	}
+	name, _, _, err := naming.Apply(pm.Type, name, nil)
+	if err != nil {
+		// rejected names never reach the store
+		return "", false
+	}
+	return name, true
+}
+
+// validateMetricFamilies rejects templates whose static names collide with
+// different metric types. All series of a name share one metric family, so
+// the datapoints of one of the templates would fail at runtime, e.g. when a
+// stream fans out to templates of different types.
+func (c *Config) validateMetricFamilies() error {
+	type family struct {
+		metricType string
+		template   string
+	}
+	families := make(map[string]family)
+	for i := range c.Flows {
+		fp := &c.Flows[i]
+		for j := range fp.MetricTemplates {
+			mt := &fp.MetricTemplates[j]
+			name, ok := mt.staticName(fp, c.Naming)
+			if !ok {
+				continue
+			}
+			existing, ok := families[name]
+			if !ok {
+				families[name] = family{metricType: familyType(mt.Type), template: mt.ID()}
+				continue
+			}
+			if existing.metricType != familyType(mt.Type) {
+				return fmt.Errorf("Metric %s of template %s is a %s, but template %s already declares it as %s",
+					name, mt.ID(), mt.Type, existing.template, existing.metricType)
+			}
+		}
+	}
+	return nil
+}
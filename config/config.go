@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"regexp"
+	"sort"
+	"strings"
 	"text/template"
 	"time"
 
@@ -18,23 +21,177 @@ type GroupReadyCondition struct {
 type Grouping struct {
 	Label               string
 	GroupReadyCondition GroupReadyCondition `yaml:"groupReadyCondition"`
+	Scrape              *ScrapeOptions      `yaml:"scrape"`
+}
+
+// ScrapeOptions returns the scrape options of the grouping endpoint, falling
+// back to the options of the config when the grouping declares none
+func (g Grouping) ScrapeOptions(defaults ScrapeOptions) ScrapeOptions {
+	if g.Scrape != nil {
+		return *g.Scrape
+	}
+	return defaults
+}
+
+// AutoLabels exposes SignalFx dimensions as Prometheus labels without
+// declaring each one of them explicitely
+type AutoLabels struct {
+	Include        []string          `yaml:"include"`
+	Exclude        []string          `yaml:"exclude"`
+	Rename         map[string]string `yaml:"rename"`
+	includeRegexes []*regexp.Regexp
+	excludeRegexes []*regexp.Regexp
+}
+
+func compileAnchored(exprs []string) ([]*regexp.Regexp, error) {
+	regexes := make([]*regexp.Regexp, len(exprs))
+	for i, expr := range exprs {
+		r, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regex %s - %+s", expr, err)
+		}
+		regexes[i] = r
+	}
+	return regexes, nil
+}
+
+func (al *AutoLabels) Validate() error {
+	var err error
+	if al.includeRegexes, err = compileAnchored(al.Include); err != nil {
+		return err
+	}
+	if al.excludeRegexes, err = compileAnchored(al.Exclude); err != nil {
+		return err
+	}
+	for dimension, labelName := range al.Rename {
+		if !labelNameRegex.MatchString(labelName) {
+			return fmt.Errorf("Dimension %s can't be renamed to invalid label name %s", dimension, labelName)
+		}
+	}
+	return nil
+}
+
+func matchesAny(regexes []*regexp.Regexp, s string) bool {
+	for _, r := range regexes {
+		if r.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Labels maps dimensions to Prometheus labels. Include and exclude regexes are
+// matched against the original dimension names. Dimensions without a rename
+// entry get their name sanitized. When several dimensions map to the same
+// label, a renamed dimension wins over a dimension that already has the label
+// name, which wins over sanitized dimensions. Remaining ties go to the first
+// dimension in sorted order, so the label value doesn't depend on map order.
+func (al *AutoLabels) Labels(dimensions map[string]string) map[string]string {
+	dimensionNames := make([]string, 0, len(dimensions))
+	for dimension := range dimensions {
+		dimensionNames = append(dimensionNames, dimension)
+	}
+	sort.Strings(dimensionNames)
+
+	labels := make(map[string]string, len(dimensions))
+	priorities := make(map[string]int, len(dimensions))
+	for _, dimension := range dimensionNames {
+		if len(al.includeRegexes) > 0 && !matchesAny(al.includeRegexes, dimension) {
+			continue
+		}
+		if matchesAny(al.excludeRegexes, dimension) {
+			continue
+		}
+		labelName, ok := al.Rename[dimension]
+		priority := 2
+		if !ok {
+			labelName = SanitizeLabelName(dimension)
+			priority = 0
+			if labelName == dimension {
+				priority = 1
+			}
+		}
+		if current, ok := priorities[labelName]; ok && current >= priority {
+			continue
+		}
+		labels[labelName] = dimensions[dimension]
+		priorities[labelName] = priority
+	}
+	return labels
 }
 
 type PrometheusMetric struct {
-	Name           string            `yaml:"name"`
-	Stream         string            `yaml:"stream"`
-	Type           string            `yaml:"type"`
-	Labels         map[string]string `yaml:"labels"`
+	Name           string               `yaml:"name"`
+	Stream         string               `yaml:"stream"`
+	Type           string               `yaml:"type"`
+	Labels         map[string]string    `yaml:"labels"`
+	AutoLabels     *AutoLabels          `yaml:"autoLabels"`
+	RelabelConfigs []RelabelConfig      `yaml:"relabelConfigs"`
+	Value          *ValueTransformation `yaml:"value"`
+	Histogram      *Histogram           `yaml:"histogram"`
+	Summary        *Summary             `yaml:"summary"`
+	StateSet       *StateSet            `yaml:"stateset"`
+	StreamRegex    string               `yaml:"streamRegex"`
+	Fallback       bool                 `yaml:"fallback"`
+	Match          []Matcher            `yaml:"match"`
+	Help           string               `yaml:"help"`
+	Unit           string               `yaml:"unit"`
+	MaxSeries      int                  `yaml:"maxSeries"`
+	id             string
+	index          int
+	streamRegex    *regexp.Regexp
 	nameTemplate   template.Template
+	helpTemplate   template.Template
 	labelTemplates map[string]template.Template
 }
 
+// ID identifies the template by its flow and position within the flow
+func (pm *PrometheusMetric) ID() string {
+	return pm.id
+}
+
+// Index is the position of the template within its flow
+func (pm *PrometheusMetric) Index() int {
+	return pm.index
+}
+
 type NameTemplateVars struct {
 	SignalFxMetricName string
 	SignalFxLabels     map[string]string
 }
 
 func (pm *PrometheusMetric) Validate() error {
+	if err := validateMetricType(pm.Type); err != nil {
+		return err
+	}
+
+	// stream selection
+	selectors := 0
+	for _, selected := range []bool{pm.Stream != "", pm.StreamRegex != "", pm.Fallback, pm.Type == "summary"} {
+		if selected {
+			selectors++
+		}
+	}
+	if selectors > 1 {
+		return fmt.Errorf("Only one of stream, streamRegex, fallback or a summary section can select the streams of a template")
+	}
+	if pm.StreamRegex != "" {
+		regexes, err := compileAnchored([]string{pm.StreamRegex})
+		if err != nil {
+			return err
+		}
+		pm.streamRegex = regexes[0]
+	} else if selectors == 0 {
+		pm.Stream = "default"
+	}
+
+	// datapoint matchers
+	for i := range pm.Match {
+		if err := pm.Match[i].Validate(); err != nil {
+			return err
+		}
+	}
+
 	// name template
 	name := pm.Name
 	if name == "" {
@@ -46,9 +203,28 @@ func (pm *PrometheusMetric) Validate() error {
 	}
 	pm.nameTemplate = *tmpl
 
+	// help template
+	tmpl, err = template.New("x").Parse(pm.Help)
+	if err != nil {
+		return err
+	}
+	pm.helpTemplate = *tmpl
+
+	// unit
+	if pm.Unit != "" && !unitRegex.MatchString(pm.Unit) {
+		return fmt.Errorf("Invalid unit %s", pm.Unit)
+	}
+
+	if pm.MaxSeries < 0 {
+		return fmt.Errorf("maxSeries must not be negative")
+	}
+
 	// label templates
 	labelTemplates := map[string]template.Template{}
 	for labelName, labelValue := range pm.Labels {
+		if !IsValidLabelName(labelName) {
+			return fmt.Errorf("Invalid label name %s", labelName)
+		}
 		tmpl, err := template.New("x").Parse(labelValue)
 		if err != nil {
 			return err
@@ -57,15 +233,119 @@ func (pm *PrometheusMetric) Validate() error {
 	}
 	pm.labelTemplates = labelTemplates
 
+	// automatic labels
+	if pm.AutoLabels != nil {
+		if err := pm.AutoLabels.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for i := range pm.RelabelConfigs {
+		if err := pm.RelabelConfigs[i].Validate(); err != nil {
+			return err
+		}
+	}
+
+	// value transformation
+	if pm.Value != nil {
+		if err := pm.Value.Validate(); err != nil {
+			return err
+		}
+	}
+
+	// histogram assembly
+	if pm.Type == "histogram" {
+		if pm.Histogram == nil {
+			return fmt.Errorf("Histogram templates require a histogram section")
+		}
+		if err := pm.Histogram.Validate(); err != nil {
+			return err
+		}
+		if _, ok := pm.Labels["le"]; ok {
+			return fmt.Errorf("Histogram templates can't declare the reserved label le")
+		}
+	}
+
+	// summary assembly
+	if pm.Type == "summary" {
+		if pm.Summary == nil {
+			return fmt.Errorf("Summary templates require a summary section")
+		}
+		if err := pm.Summary.Validate(); err != nil {
+			return err
+		}
+		if _, ok := pm.Labels["quantile"]; ok {
+			return fmt.Errorf("Summary templates can't declare the reserved label quantile")
+		}
+	}
+
+	// state set mapping
+	if pm.Type == "stateset" {
+		if pm.StateSet == nil {
+			return fmt.Errorf("State set templates require a stateset section")
+		}
+		if err := pm.StateSet.Validate(); err != nil {
+			return err
+		}
+		if _, ok := pm.Labels[pm.StateSet.Label]; ok {
+			return fmt.Errorf("State set templates can't declare the state label %s", pm.StateSet.Label)
+		}
+	}
+
 	return nil
 }
 
+// Streams returns all streams whose datapoints are processed by the template
+// by exact match. Summary templates are selected by their quantile, sum and
+// count streams.
+func (pm *PrometheusMetric) Streams() []string {
+	if pm.Type == "summary" {
+		return pm.Summary.Streams()
+	}
+	streams := []string{}
+	if pm.Stream != "" {
+		streams = append(streams, pm.Stream)
+	}
+	if pm.Type == "histogram" {
+		for _, stream := range []string{pm.Histogram.SumStream, pm.Histogram.CountStream} {
+			if stream != "" {
+				streams = append(streams, stream)
+			}
+		}
+	}
+	return streams
+}
+
 func (pm *PrometheusMetric) GetMetricName(data NameTemplateVars) (string, error) {
 	var buffer bytes.Buffer
 	err := pm.nameTemplate.Execute(&buffer, data)
 	return buffer.String(), err
 }
 
+func (pm *PrometheusMetric) GetHelp(data NameTemplateVars) (string, error) {
+	var buffer bytes.Buffer
+	err := pm.helpTemplate.Execute(&buffer, data)
+	return buffer.String(), err
+}
+
+// ApplyUnitSuffix appends the unit of the metric to a metric name if it is
+// missing, as required by OpenMetrics. For counters the unit is placed before
+// a _total suffix.
+func (pm *PrometheusMetric) ApplyUnitSuffix(name string) string {
+	if pm.Unit == "" {
+		return name
+	}
+	suffix := ""
+	if pm.Type == "counter" && strings.HasSuffix(name, "_total") {
+		name = strings.TrimSuffix(name, "_total")
+		suffix = "_total"
+	}
+	if !strings.HasSuffix(name, "_"+pm.Unit) {
+		name = name + "_" + pm.Unit
+	}
+	return name + suffix
+}
+
 func (pm *PrometheusMetric) GetLabelValue(labelName string, data NameTemplateVars) (string, error) {
 	tmpl, ok := pm.labelTemplates[labelName]
 	if !ok {
@@ -76,39 +356,224 @@ func (pm *PrometheusMetric) GetLabelValue(labelName string, data NameTemplateVar
 	return buffer.String(), err
 }
 
+// GetLabels renders all labels of the metric. Labels from explicit templates
+// take precedence over automatically mapped dimensions.
+func (pm *PrometheusMetric) GetLabels(data NameTemplateVars) (map[string]string, error) {
+	labels := map[string]string{}
+	if pm.AutoLabels != nil {
+		labels = pm.AutoLabels.Labels(data.SignalFxLabels)
+	}
+	for labelName := range pm.Labels {
+		value, err := pm.GetLabelValue(labelName, data)
+		if err != nil {
+			return nil, err
+		}
+		labels[labelName] = value
+	}
+	return labels, nil
+}
+
+// TransformValue applies the value transformation of the metric if one is
+// configured. The second return value is false when the value should be dropped.
+func (pm *PrometheusMetric) TransformValue(value float64) (float64, bool) {
+	if pm.Value == nil {
+		return value, true
+	}
+	return pm.Value.Apply(value)
+}
+
+// SortedLabelNames returns the label names of a label map in a stable order
+func SortedLabelNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 type FlowProgram struct {
 	Name              string             `yaml:"name"`
 	Query             string             `yaml:"query"`
 	HistoricalData    time.Duration      `yaml:"historicalData"`
 	MetricTemplates   []PrometheusMetric `yaml:"prometheusMetricTemplates"`
-	templatesByStream map[string]PrometheusMetric
+	RelabelConfigs    []RelabelConfig    `yaml:"relabelConfigs"`
+	ConstLabels       map[string]string  `yaml:"constLabels"`
+	Queue             Queue              `yaml:"queue"`
+	MaxSeries         int                `yaml:"maxSeries"`
+	MemoryBudget      ByteSize           `yaml:"memoryBudget"`
+	ScrapeGroup       string             `yaml:"scrapeGroup"`
+	templatesByStream map[string][]PrometheusMetric
+	regexTemplates    []PrometheusMetric
+	fallbackTemplates []PrometheusMetric
+	constantLabels    map[string]string
+}
+
+// ConstantLabels returns the constant labels of the flow merged with the
+// external labels of the config
+func (fp *FlowProgram) ConstantLabels() map[string]string {
+	return fp.constantLabels
+}
+
+func (fp *FlowProgram) validateConstantLabels(externalLabels map[string]string) error {
+	fp.constantLabels = make(map[string]string, len(externalLabels)+len(fp.ConstLabels))
+	for labelName, value := range externalLabels {
+		fp.constantLabels[labelName] = value
+	}
+	for labelName, value := range fp.ConstLabels {
+		if !IsValidLabelName(labelName) {
+			return fmt.Errorf("Invalid constant label name %s in flow %s", labelName, fp.Name)
+		}
+		if _, ok := externalLabels[labelName]; ok {
+			return fmt.Errorf("Constant label %s of flow %s shadows an external label", labelName, fp.Name)
+		}
+		fp.constantLabels[labelName] = value
+	}
+
+	// template labels must not shadow constant labels
+	shadows := func(labelName string) error {
+		if _, ok := fp.constantLabels[labelName]; ok {
+			return fmt.Errorf("Label %s of a metric template in flow %s shadows a constant label", labelName, fp.Name)
+		}
+		return nil
+	}
+	relabelTargets := func(configs []RelabelConfig) error {
+		for _, rc := range configs {
+			if rc.Action == RelabelReplace || rc.Action == RelabelHashMod {
+				if err := shadows(rc.TargetLabel); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	for _, mt := range fp.MetricTemplates {
+		for labelName := range mt.Labels {
+			if err := shadows(labelName); err != nil {
+				return err
+			}
+		}
+		// labels holding the bucket bound, quantile or state of a series
+		var partLabels []string
+		switch mt.Type {
+		case "histogram":
+			partLabels = []string{"le", SanitizeLabelName(mt.Histogram.BucketLabel)}
+		case "summary":
+			partLabels = []string{"quantile"}
+		case "stateset":
+			partLabels = []string{mt.StateSet.Label}
+		}
+		for _, labelName := range partLabels {
+			if err := shadows(labelName); err != nil {
+				return err
+			}
+		}
+		if mt.AutoLabels != nil {
+			for _, labelName := range mt.AutoLabels.Rename {
+				if err := shadows(labelName); err != nil {
+					return err
+				}
+			}
+		}
+		if err := relabelTargets(mt.RelabelConfigs); err != nil {
+			return err
+		}
+	}
+	return relabelTargets(fp.RelabelConfigs)
+}
+
+// GetMetricTemplatesForStream returns all templates that process the
+// datapoints of a stream, in the order they are declared. Templates selecting
+// the stream by name take precedence over templates selecting it by regex.
+// Fallback templates are only used when no other template matches.
+func (fp *FlowProgram) GetMetricTemplatesForStream(stream string) ([]PrometheusMetric, error) {
+	if templates, ok := fp.templatesByStream[stream]; ok {
+		return templates, nil
+	}
+	templates := []PrometheusMetric{}
+	for _, mt := range fp.regexTemplates {
+		if mt.streamRegex.MatchString(stream) {
+			templates = append(templates, mt)
+		}
+	}
+	if len(templates) == 0 {
+		templates = fp.fallbackTemplates
+	}
+	if len(templates) == 0 {
+		return nil, fmt.Errorf("No metric template found for stream %s", stream)
+	}
+	return templates, nil
 }
 
+// GetMetricTemplateForStream returns the first template that processes the
+// datapoints of a stream
 func (fp *FlowProgram) GetMetricTemplateForStream(stream string) (PrometheusMetric, error) {
-	mt, ok := fp.templatesByStream[stream]
-	if !ok {
-		return PrometheusMetric{}, fmt.Errorf("No metric template found for stream %s", stream)
+	templates, err := fp.GetMetricTemplatesForStream(stream)
+	if err != nil {
+		return PrometheusMetric{}, err
 	}
-	return mt, nil
+	return templates[0], nil
+}
+
+// SelectMetricTemplates returns the templates that process a datapoint of a
+// stream. Templates without matchers are always selected. Of the templates
+// with matchers, only the first one matching the datapoint is selected. The
+// result is empty when no template matches.
+func (fp *FlowProgram) SelectMetricTemplates(stream string, dimensions map[string]string, properties map[string]interface{}) []PrometheusMetric {
+	templates, err := fp.GetMetricTemplatesForStream(stream)
+	if err != nil {
+		return nil
+	}
+	selected := make([]PrometheusMetric, 0, len(templates))
+	conditionalMatched := false
+	for _, mt := range templates {
+		if len(mt.Match) == 0 {
+			selected = append(selected, mt)
+		} else if !conditionalMatched && mt.Matches(dimensions, properties) {
+			selected = append(selected, mt)
+			conditionalMatched = true
+		}
+	}
+	return selected
 }
 
 func (fp *FlowProgram) Validate() error {
-	defaultStreamFound := false
-	fp.templatesByStream = make(map[string]PrometheusMetric)
+	if err := fp.Queue.Validate(); err != nil {
+		return err
+	}
+	for i := range fp.RelabelConfigs {
+		if err := fp.RelabelConfigs[i].Validate(); err != nil {
+			return err
+		}
+	}
+	fp.templatesByStream = make(map[string][]PrometheusMetric)
+	fp.regexTemplates = []PrometheusMetric{}
+	fp.fallbackTemplates = []PrometheusMetric{}
+	if fp.MaxSeries < 0 {
+		return fmt.Errorf("maxSeries of flow %s must not be negative", fp.Name)
+	}
+	if !pathSegmentRegex.MatchString(fp.Name) {
+		return fmt.Errorf("Invalid flow name %q", fp.Name)
+	}
+	if fp.ScrapeGroup != "" && !pathSegmentRegex.MatchString(fp.ScrapeGroup) {
+		return fmt.Errorf("Invalid scrape group %s of flow %s", fp.ScrapeGroup, fp.Name)
+	}
 	for i := range fp.MetricTemplates {
 		mtp := &fp.MetricTemplates[i]
 		if err := mtp.Validate(); err != nil {
 			return err
 		}
-		if mtp.Stream == "" {
-			mtp.Stream = "default"
+		mtp.id = fmt.Sprintf("%s/%d", fp.Name, i)
+		mtp.index = i
+		for _, stream := range mtp.Streams() {
+			fp.templatesByStream[stream] = append(fp.templatesByStream[stream], *mtp)
 		}
-		if mtp.Stream == "default" && defaultStreamFound {
-			return fmt.Errorf("More than one default stream found in flow %s", fp.Name)
-		} else if mtp.Stream == "default" {
-			defaultStreamFound = true
+		if mtp.streamRegex != nil {
+			fp.regexTemplates = append(fp.regexTemplates, *mtp)
+		}
+		if mtp.Fallback {
+			fp.fallbackTemplates = append(fp.fallbackTemplates, *mtp)
 		}
-		fp.templatesByStream[mtp.Stream] = *mtp
 	}
 	return nil
 }
@@ -126,22 +591,55 @@ func (sfx *Sfx) Validate() error {
 }
 
 type Config struct {
-	Sfx       Sfx           `yaml:"sfx"`
-	Flows     []FlowProgram `yaml:"flows"`
-	Groupings []Grouping    `yaml:"grouping"`
+	Sfx            Sfx               `yaml:"sfx"`
+	Flows          []FlowProgram     `yaml:"flows"`
+	Groupings      []Grouping        `yaml:"grouping"`
+	Naming         Naming            `yaml:"naming"`
+	ExternalLabels map[string]string `yaml:"externalLabels"`
+	Scrape         ScrapeOptions     `yaml:"scrape"`
+	MaxSeries      int               `yaml:"maxSeries"`
 }
 
 func (c *Config) Validate() error {
 	if err := c.Sfx.Validate(); err != nil {
 		return err
 	}
+	if err := c.Naming.Validate(); err != nil {
+		return err
+	}
+	if err := c.Scrape.Validate(); err != nil {
+		return err
+	}
+	if c.MaxSeries < 0 {
+		return fmt.Errorf("maxSeries must not be negative")
+	}
+	for i := range c.Groupings {
+		if scrape := c.Groupings[i].Scrape; scrape != nil {
+			if err := scrape.Validate(); err != nil {
+				return fmt.Errorf("Invalid scrape options of grouping %s - %+s", c.Groupings[i].Label, err)
+			}
+		}
+	}
+	for labelName := range c.ExternalLabels {
+		if !IsValidLabelName(labelName) {
+			return fmt.Errorf("Invalid external label name %s", labelName)
+		}
+	}
+	flowNames := make(map[string]bool, len(c.Flows))
 	for i := range c.Flows {
 		fp := &c.Flows[i]
+		if flowNames[fp.Name] {
+			return fmt.Errorf("Duplicate flow name %s", fp.Name)
+		}
+		flowNames[fp.Name] = true
 		if err := fp.Validate(); err != nil {
 			return err
 		}
+		if err := fp.validateConstantLabels(c.ExternalLabels); err != nil {
+			return err
+		}
 	}
-	return nil
+	return c.validateMetricFamilies()
 }
 
 func LoadConfigFromBytes(configBytes []byte) (*Config, error) {
@@ -152,7 +650,10 @@ func LoadConfigFromBytes(configBytes []byte) (*Config, error) {
 		return nil, err
 	}
 
-	cfg.Validate()
+	if err := cfg.Validate(); err != nil {
+		log.Printf("Validate: %v\n", err)
+		return nil, err
+	}
 	return &cfg, nil
 }
 
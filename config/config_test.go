@@ -1,6 +1,7 @@
 package config_test
 
 import (
+	"fmt"
 	"signalfx-prometheus-exporter/config"
 	"testing"
 	"time"
@@ -92,3 +93,605 @@ flows:
 	ninty_nine, _ := time.ParseDuration("99s")
 	assert.Equal(t, cfg.Flows[0].HistoricalData, ninty_nine)
 }
+
+func TestAutoLabels(t *testing.T) {
+	c, err := config.LoadConfig("../examples/4_auto_labels.yml")
+	assert.Nil(t, err)
+	mt, err := c.Flows[0].GetMetricTemplateForStream("default")
+	assert.Nil(t, err)
+
+	labels, err := mt.GetLabels(config.NameTemplateVars{
+		SignalFxLabels: map[string]string{
+			"cp_testname":  "test",
+			"cp_test.type": "web",
+			"cp_testid":    "42",
+			"host":         "abc",
+			"owner":        "team",
+		},
+		SignalFxMetricName: "test",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"instance":     "test",
+		"cp_test_type": "web",
+		"owner":        "test-team",
+	}, labels)
+}
+
+func TestAutoLabelsCollisions(t *testing.T) {
+	al := &config.AutoLabels{Rename: map[string]string{"renamed": "a_b"}}
+	assert.Nil(t, al.Validate())
+	for i := 0; i < 20; i++ {
+		// map iteration order must not change the result
+		assert.Equal(t, map[string]string{"a_b": "exact", "c_d": "dash"}, al.Labels(map[string]string{
+			"a.b": "dot", "a_b": "exact", "a-b": "dash", "c.d": "dot", "c-d": "dash",
+		}))
+		assert.Equal(t, map[string]string{"a_b": "renamed"}, al.Labels(map[string]string{
+			"a.b": "dot", "a_b": "exact", "renamed": "renamed",
+		}))
+	}
+}
+
+func TestAutoLabelsInvalidRegex(t *testing.T) {
+	configFile := `---
+flows:
+- name: catchpoint-data
+  query: data('catchpoint.counterrequests').publish()
+  prometheusMetricTemplates:
+  - type: counter
+    autoLabels:
+      include: ['cp_(']
+`
+	_, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Invalid regex")
+}
+
+func TestSanitizeLabelName(t *testing.T) {
+	assert.Equal(t, "cp_test_name", config.SanitizeLabelName("cp_test-name"))
+	assert.Equal(t, "_1st", config.SanitizeLabelName("1st"))
+	assert.Equal(t, "a_b_c", config.SanitizeLabelName("a.b:c"))
+}
+
+func TestConstantLabels(t *testing.T) {
+	configFile := `---
+externalLabels:
+  source: signalfx
+  realm: us1
+flows:
+- name: catchpoint-data
+  query: data('catchpoint.counterrequests').publish()
+  constLabels:
+    env: prod
+  prometheusMetricTemplates:
+  - type: counter
+    labels:
+      instance: '{{ .SignalFxLabels.cp_testname }}'
+`
+	cfg, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"source": "signalfx",
+		"realm":  "us1",
+		"env":    "prod",
+	}, cfg.Flows[0].ConstantLabels())
+}
+
+func TestConstantLabelsShadowed(t *testing.T) {
+	shadowingFlows := []string{`
+- name: const-label-shadows-external-label
+  query: data('catchpoint.counterrequests').publish()
+  constLabels:
+    source: other
+`, `
+- name: template-label-shadows-const-label
+  query: data('catchpoint.counterrequests').publish()
+  constLabels:
+    env: prod
+  prometheusMetricTemplates:
+  - type: counter
+    labels:
+      env: '{{ .SignalFxLabels.env }}'
+`, `
+- name: auto-label-shadows-external-label
+  query: data('catchpoint.counterrequests').publish()
+  prometheusMetricTemplates:
+  - type: counter
+    autoLabels:
+      rename:
+        sf_source: source
+`, `
+- name: relabel-shadows-external-label
+  query: data('catchpoint.counterrequests').publish()
+  relabelConfigs:
+  - sourceLabels: [instance]
+    targetLabel: source
+`, `
+- name: state-label-shadows-const-label
+  query: data('check.state').publish()
+  constLabels:
+    state: prod
+  prometheusMetricTemplates:
+  - type: stateset
+    stateset:
+      states:
+        0: ok
+        1: failed
+`, `
+- name: bucket-label-shadows-const-label
+  query: data('request.duration').publish()
+  constLabels:
+    le: prod
+  prometheusMetricTemplates:
+  - type: histogram
+    histogram:
+      buckets: [0.1, 1]
+`, `
+- name: quantile-label-shadows-external-label
+  query: data('request.duration').publish()
+  prometheusMetricTemplates:
+  - type: summary
+    summary:
+      quantiles:
+        p50: 0.5
+`}
+	for _, flow := range shadowingFlows {
+		configFile := `---
+externalLabels:
+  source: signalfx
+  quantile: median
+flows:` + flow
+		_, err := config.LoadConfigFromBytes([]byte(configFile))
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "shadows")
+	}
+}
+
+func TestExampleHistogram(t *testing.T) {
+	c, err := config.LoadConfig("../examples/5_histogram.yml")
+	assert.Nil(t, err)
+
+	for _, stream := range []string{"buckets", "sum", "count"} {
+		mt, err := c.Flows[0].GetMetricTemplateForStream(stream)
+		assert.Nil(t, err)
+		assert.Equal(t, "histogram", mt.Type)
+	}
+	mt, _ := c.Flows[0].GetMetricTemplateForStream("sum")
+	assert.Equal(t, config.SumPart, mt.Histogram.PartForStream("sum"))
+	assert.Equal(t, config.CountPart, mt.Histogram.PartForStream("count"))
+	assert.Equal(t, config.ValuePart, mt.Histogram.PartForStream("buckets"))
+	assert.Equal(t, 4, len(mt.Histogram.BucketBounds()))
+}
+
+func TestHistogramRequiresBuckets(t *testing.T) {
+	for _, histogram := range []string{"", "\n    histogram:\n      bucketLabel: le", "\n    histogram:\n      buckets: []"} {
+		_, err := config.LoadConfigFromBytes([]byte(`---
+flows:
+- name: request-durations
+  query: data('request.duration.bucket').publish()
+  prometheusMetricTemplates:
+  - type: histogram
+    name: request_duration_seconds` + histogram + "\n"))
+		assert.NotNil(t, err, histogram)
+	}
+}
+
+func TestExampleSummary(t *testing.T) {
+	c, err := config.LoadConfig("../examples/6_summary.yml")
+	assert.Nil(t, err)
+
+	for _, stream := range []string{"p50", "p90", "p99", "count"} {
+		mt, err := c.Flows[0].GetMetricTemplateForStream(stream)
+		assert.Nil(t, err)
+		assert.Equal(t, "summary", mt.Type)
+	}
+	_, err = c.Flows[0].GetMetricTemplateForStream("default")
+	assert.NotNil(t, err)
+
+	mt, _ := c.Flows[0].GetMetricTemplateForStream("p90")
+	quantile, ok := mt.Summary.QuantileForStream("p90")
+	assert.True(t, ok)
+	assert.Equal(t, 0.9, quantile)
+	assert.Equal(t, config.CountPart, mt.Summary.PartForStream("count"))
+}
+
+func TestStreamRouting(t *testing.T) {
+	c, err := config.LoadConfig("../examples/9_stream_routing.yml")
+	assert.Nil(t, err)
+	fp := c.Flows[0]
+
+	// fan out to all templates of a stream in declaration order
+	templates, err := fp.GetMetricTemplatesForStream("p99")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(templates))
+	assert.Equal(t, "summary", templates[0].Type)
+	assert.Equal(t, "gauge", templates[1].Type)
+
+	// exact stream matches take precedence over regex matches
+	templates, _ = fp.GetMetricTemplatesForStream("p50")
+	assert.Equal(t, 1, len(templates))
+	assert.Equal(t, "summary", templates[0].Type)
+
+	// regex matches
+	templates, _ = fp.GetMetricTemplatesForStream("errors_5xx")
+	assert.Equal(t, 1, len(templates))
+	assert.Equal(t, "counter", templates[0].Type)
+
+	// fallback when nothing else matches
+	templates, _ = fp.GetMetricTemplatesForStream("default")
+	assert.Equal(t, 1, len(templates))
+	assert.True(t, templates[0].Fallback)
+}
+
+func TestFanOutTypeConflict(t *testing.T) {
+	load := func(templates string) error {
+		_, err := config.LoadConfigFromBytes([]byte(`---
+flows:
+- name: request-durations
+  query: data('request.duration').percentile(50).publish('p50')
+  prometheusMetricTemplates:` + templates))
+		return err
+	}
+	gauge := `
+  - type: gauge
+    stream: p50
+    name: request_duration_seconds`
+	summary := `
+  - type: summary
+    name: request_duration_seconds
+    summary:
+      quantiles:
+        p50: 0.5`
+	for _, templates := range []string{gauge + summary, summary + gauge} {
+		err := load(templates)
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "already declares it as")
+	}
+
+	// unit suffixes are applied before names are compared
+	err := load(`
+  - type: gauge
+    stream: p50
+    name: request_duration
+    unit: seconds
+  - type: counter
+    stream: p50
+    name: request_duration_seconds`)
+	assert.NotNil(t, err)
+
+	// same types, names that depend on the datapoint and renames are fine
+	assert.Nil(t, load(gauge+gauge))
+	assert.Nil(t, load(gauge+`
+  - type: counter
+    stream: p50
+    name: '{{ .SignalFxMetricName }}'`))
+	assert.Nil(t, load(gauge+`
+  - type: counter
+    stream: p50
+    name: request_duration_seconds
+    relabelConfigs:
+    - sourceLabels: [__name__]
+      targetLabel: __name__
+      replacement: request_duration_seconds_total`))
+}
+
+func TestStreamSelectorsExclusive(t *testing.T) {
+	configFile := `---
+flows:
+- name: catchpoint-data
+  query: data('catchpoint.counterrequests').publish('requests')
+  prometheusMetricTemplates:
+  - type: counter
+    stream: requests
+    streamRegex: 'req.*'
+`
+	_, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Only one of")
+}
+
+func TestExampleStateSet(t *testing.T) {
+	c, err := config.LoadConfig("../examples/7_stateset.yml")
+	assert.Nil(t, err)
+	mt, err := c.Flows[0].GetMetricTemplateForStream("default")
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"critical", "ok", "warn"}, mt.StateSet.StateNames())
+	state, ok := mt.StateSet.StateForValue(2)
+	assert.True(t, ok)
+	assert.Equal(t, "critical", state)
+	_, ok = mt.StateSet.StateForValue(3)
+	assert.False(t, ok)
+}
+
+func TestExampleInfoMetric(t *testing.T) {
+	c, err := config.LoadConfig("../examples/8_info_metric.yml")
+	assert.Nil(t, err)
+	mt, err := c.Flows[0].GetMetricTemplateForStream("info")
+	assert.Nil(t, err)
+	assert.Equal(t, "info", mt.Type)
+}
+
+func TestConditionalTemplates(t *testing.T) {
+	c, err := config.LoadConfig("../examples/10_conditional_templates.yml")
+	assert.Nil(t, err)
+	fp := c.Flows[0]
+	properties := map[string]interface{}{"sf_metric": "catchpoint.responsetime"}
+
+	templates := fp.SelectMetricTemplates("default", map[string]string{"cp_testtype": "web"}, properties)
+	assert.Equal(t, 1, len(templates))
+	assert.Equal(t, "catchpoint_web_response_time_ms", templates[0].Name)
+
+	templates = fp.SelectMetricTemplates("default", map[string]string{"cp_testtype": "api"}, properties)
+	assert.Equal(t, 1, len(templates))
+	assert.Equal(t, "catchpoint_transaction_response_time_ms", templates[0].Name)
+
+	templates = fp.SelectMetricTemplates("default", map[string]string{"cp_testtype": "api"}, map[string]interface{}{})
+	assert.Equal(t, 1, len(templates))
+	assert.Equal(t, "catchpoint_response_time_ms", templates[0].Name)
+
+	templates = fp.SelectMetricTemplates("other", map[string]string{}, properties)
+	assert.Empty(t, templates)
+}
+
+func TestConditionalAndUnconditionalTemplates(t *testing.T) {
+	configFile := `---
+flows:
+- name: catchpoint-data
+  query: data('catchpoint.responsetime').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    name: web
+    match:
+    - name: cp_testtype
+      value: web
+  - type: info
+    name: test
+`
+	cfg, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+
+	templates := cfg.Flows[0].SelectMetricTemplates("default", map[string]string{"cp_testtype": "web"}, nil)
+	assert.Equal(t, 2, len(templates))
+	templates = cfg.Flows[0].SelectMetricTemplates("default", map[string]string{"cp_testtype": "api"}, nil)
+	assert.Equal(t, 1, len(templates))
+	assert.Equal(t, "test", templates[0].Name)
+}
+
+func TestMatcherValidation(t *testing.T) {
+	configFile := `---
+flows:
+- name: catchpoint-data
+  query: data('catchpoint.responsetime').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    match:
+    - name: cp_testtype
+`
+	_, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "either a value or a regex")
+}
+
+func TestApplyUnitSuffix(t *testing.T) {
+	gauge := config.PrometheusMetric{Type: "gauge", Unit: "seconds"}
+	assert.Equal(t, "latency_seconds", gauge.ApplyUnitSuffix("latency"))
+	assert.Equal(t, "latency_seconds", gauge.ApplyUnitSuffix("latency_seconds"))
+
+	counter := config.PrometheusMetric{Type: "counter", Unit: "bytes"}
+	assert.Equal(t, "sent_bytes_total", counter.ApplyUnitSuffix("sent_total"))
+	assert.Equal(t, "sent_bytes_total", counter.ApplyUnitSuffix("sent_bytes_total"))
+	assert.Equal(t, "sent_bytes", counter.ApplyUnitSuffix("sent"))
+
+	noUnit := config.PrometheusMetric{Type: "gauge"}
+	assert.Equal(t, "latency", noUnit.ApplyUnitSuffix("latency"))
+}
+
+func TestInvalidUnit(t *testing.T) {
+	configFile := `---
+flows:
+- name: catchpoint-data
+  query: data('catchpoint.responsetime').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    unit: Seconds
+`
+	_, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Invalid unit")
+}
+
+func TestScrapeOptions(t *testing.T) {
+	configFile := `---
+scrape:
+  openMetrics: true
+  maxConcurrentScrapes: 2
+grouping:
+- label: instance
+- label: cluster
+  scrape:
+    errorHandling: continue
+`
+	cfg, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+	assert.Equal(t, config.ErrorHandlingFail, cfg.Scrape.ErrorHandling)
+
+	instance := cfg.Groupings[0].ScrapeOptions(cfg.Scrape)
+	assert.True(t, instance.OpenMetrics)
+	assert.Equal(t, 2, instance.MaxConcurrentScrapes)
+
+	cluster := cfg.Groupings[1].ScrapeOptions(cfg.Scrape)
+	assert.False(t, cluster.OpenMetrics)
+	assert.Equal(t, config.ErrorHandlingContinue, cluster.ErrorHandling)
+
+	_, err = config.LoadConfigFromBytes([]byte("---\nscrape:\n  errorHandling: ignore\n"))
+	assert.NotNil(t, err)
+}
+
+func TestMetricTypeRequired(t *testing.T) {
+	for _, metricType := range []string{"", "untyped"} {
+		configFile := fmt.Sprintf(`---
+flows:
+- name: catchpoint-data
+  query: data('catchpoint.responsetime').publish()
+  prometheusMetricTemplates:
+  - name: catchpoint_response_time
+    type: '%s'
+`, metricType)
+		_, err := config.LoadConfigFromBytes([]byte(configFile))
+		assert.NotNil(t, err)
+	}
+}
+
+func TestAutoMetricType(t *testing.T) {
+	mt := config.PrometheusMetric{Type: config.AutoType}
+
+	metricType, err := mt.MetricType(map[string]interface{}{config.SfMetricTypeProperty: "CUMULATIVE_COUNTER"})
+	assert.Nil(t, err)
+	assert.Equal(t, "counter", metricType)
+
+	metricType, err = mt.MetricType(map[string]interface{}{config.SfTypeProperty: "gauge"})
+	assert.Nil(t, err)
+	assert.Equal(t, "gauge", metricType)
+
+	// the rollup takes precedence over the metric type
+	metricType, err = mt.MetricType(map[string]interface{}{
+		config.SfMetricTypeProperty: "cumulative_counter",
+		config.SfRollupProperty:     "latest",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "gauge", metricType)
+
+	_, err = mt.MetricType(map[string]interface{}{config.SfTypeProperty: "MetricTimeSeries"})
+	assert.NotNil(t, err)
+
+	gauge := config.PrometheusMetric{Type: "gauge"}
+	metricType, err = gauge.MetricType(map[string]interface{}{config.SfRollupProperty: "sum"})
+	assert.Nil(t, err)
+	assert.Equal(t, "gauge", metricType)
+}
+
+func TestFlowQueue(t *testing.T) {
+	configFile := `---
+flows:
+- name: catchpoint-data
+  query: data('catchpoint.responsetime').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+- name: catchpoint-errors
+  query: data('catchpoint.errors').publish()
+  queue:
+    size: 100
+    dropPolicy: oldest
+  prometheusMetricTemplates:
+  - type: gauge
+`
+	cfg, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+	assert.Equal(t, config.DropPolicyBlock, cfg.Flows[0].Queue.DropPolicy)
+	assert.Greater(t, cfg.Flows[0].Queue.Size, 0)
+	assert.Equal(t, config.Queue{Size: 100, DropPolicy: config.DropPolicyOldest}, cfg.Flows[1].Queue)
+
+	invalid := config.Queue{DropPolicy: "random"}
+	assert.NotNil(t, invalid.Validate())
+}
+
+func TestDuplicateFlowNames(t *testing.T) {
+	configFile := `---
+flows:
+- name: catchpoint-data
+  query: data('catchpoint.responsetime').publish()
+- name: catchpoint-data
+  query: data('catchpoint.errors').publish()
+`
+	_, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.NotNil(t, err)
+}
+
+func TestMaxSeries(t *testing.T) {
+	configFile := `---
+maxSeries: 1000
+flows:
+- name: catchpoint-data
+  query: data('catchpoint.responsetime').publish()
+  maxSeries: 100
+  prometheusMetricTemplates:
+  - type: gauge
+    maxSeries: 10
+  - type: counter
+    stream: errors
+`
+	cfg, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, cfg.MaxSeries)
+	assert.Equal(t, 100, cfg.Flows[0].MaxSeries)
+	assert.Equal(t, 10, cfg.Flows[0].MetricTemplates[0].MaxSeries)
+	assert.Equal(t, "catchpoint-data/0", cfg.Flows[0].MetricTemplates[0].ID())
+	assert.Equal(t, "catchpoint-data/1", cfg.Flows[0].MetricTemplates[1].ID())
+
+	_, err = config.LoadConfigFromBytes([]byte("---\nmaxSeries: -1\n"))
+	assert.NotNil(t, err)
+}
+
+func TestScrapeGroups(t *testing.T) {
+	configFile := `---
+flows:
+- name: catchpoint-data
+  query: data('catchpoint.responsetime').publish()
+  scrapeGroup: slow
+- name: catchpoint-errors
+  query: data('catchpoint.errors').publish()
+  scrapeGroup: slow
+- name: catchpoint-availability
+  query: data('catchpoint.availability').publish()
+`
+	cfg, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{"slow": {"catchpoint-data", "catchpoint-errors"}}, cfg.ScrapeGroups())
+
+	_, err = config.LoadConfigFromBytes([]byte("---\nflows:\n- name: a\n  scrapeGroup: a/b\n"))
+	assert.NotNil(t, err)
+	for _, name := range []string{"a/b", "a b", "''"} {
+		_, err = config.LoadConfigFromBytes([]byte("---\nflows:\n- name: " + name + "\n"))
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for input, expected := range map[string]config.ByteSize{
+		"1024":   1024,
+		"512B":   512,
+		"64KiB":  64 << 10,
+		"16 MiB": 16 << 20,
+		"2GiB":   2 << 30,
+	} {
+		size, err := config.ParseByteSize(input)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, size)
+	}
+	for _, input := range []string{"", "1.5MiB", "-1", "10MB"} {
+		_, err := config.ParseByteSize(input)
+		assert.NotNil(t, err, input)
+	}
+}
+
+func TestParseMatcher(t *testing.T) {
+	m, err := config.ParseMatcher("cp_testname=web")
+	assert.Nil(t, err)
+	assert.Equal(t, "web", *m.Value)
+	m, err = config.ParseMatcher("cp_testname=~web-.*")
+	assert.Nil(t, err)
+	assert.Equal(t, "web-.*", m.Regex)
+	assert.True(t, config.MatchAll([]config.Matcher{m}, map[string]string{"cp_testname": "web-1"}, nil))
+	assert.False(t, config.MatchAll([]config.Matcher{m}, map[string]string{"cp_testname": "api"}, nil))
+
+	m, err = config.ParseMatcher("cp_testname=a=~b")
+	assert.Nil(t, err)
+	assert.Equal(t, "cp_testname", m.Name)
+	assert.Equal(t, "a=~b", *m.Value)
+
+	for _, invalid := range []string{"cp_testname", "=web", "cp_testname=~(", "cp_testname!=web", "cp_testname!~web-.*", "cp testname=web"} {
+		_, err := config.ParseMatcher(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
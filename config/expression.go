@@ -0,0 +1,157 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"unicode"
+)
+
+// expression is a compiled arithmetic expression over a datapoint value
+type expression func(value float64) float64
+
+// compileExpression parses an arithmetic expression supporting numbers, the
+// variable `value`, the operators + - * / % and parentheses
+func compileExpression(input string) (expression, error) {
+	p := &expressionParser{input: []rune(input)}
+	expr, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.input) {
+		return nil, fmt.Errorf("Unexpected character %q at position %d in expression %s", p.input[p.pos], p.pos, input)
+	}
+	return expr, nil
+}
+
+type expressionParser struct {
+	input []rune
+	pos   int
+}
+
+func (p *expressionParser) skipSpaces() {
+	for p.pos < len(p.input) && unicode.IsSpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
+
+func (p *expressionParser) peek() rune {
+	p.skipSpaces()
+	if p.pos < len(p.input) {
+		return p.input[p.pos]
+	}
+	return 0
+}
+
+func (p *expressionParser) isNumberRune() bool {
+	c := p.input[p.pos]
+	if c == '+' || c == '-' {
+		// sign of an exponent
+		return p.input[p.pos-1] == 'e'
+	}
+	return unicode.IsDigit(c) || c == '.' || c == 'e'
+}
+
+func (p *expressionParser) parseSum() (expression, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		if op == '+' {
+			left = func(v float64) float64 { return l(v) + right(v) }
+		} else {
+			left = func(v float64) float64 { return l(v) - right(v) }
+		}
+	}
+}
+
+func (p *expressionParser) parseProduct() (expression, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		switch op {
+		case '*':
+			left = func(v float64) float64 { return l(v) * right(v) }
+		case '/':
+			left = func(v float64) float64 { return l(v) / right(v) }
+		case '%':
+			left = func(v float64) float64 { return math.Mod(l(v), right(v)) }
+		}
+	}
+}
+
+func (p *expressionParser) parseUnary() (expression, error) {
+	if p.peek() == '-' {
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(v float64) float64 { return -operand(v) }, nil
+	}
+	return p.parseOperand()
+}
+
+func (p *expressionParser) parseOperand() (expression, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		inner, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("Missing closing parenthesis at position %d", p.pos)
+		}
+		p.pos++
+		return inner, nil
+	case unicode.IsDigit(c) || c == '.':
+		start := p.pos
+		for p.pos < len(p.input) && p.isNumberRune() {
+			p.pos++
+		}
+		number, err := strconv.ParseFloat(string(p.input[start:p.pos]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid number %s at position %d", string(p.input[start:p.pos]), start)
+		}
+		return func(float64) float64 { return number }, nil
+	case unicode.IsLetter(c):
+		start := p.pos
+		for p.pos < len(p.input) && unicode.IsLetter(p.input[p.pos]) {
+			p.pos++
+		}
+		if name := string(p.input[start:p.pos]); name != "value" {
+			return nil, fmt.Errorf("Unknown variable %s at position %d, only `value` is supported", name, start)
+		}
+		return func(v float64) float64 { return v }, nil
+	case c == 0:
+		return nil, fmt.Errorf("Unexpected end of expression")
+	default:
+		return nil, fmt.Errorf("Unexpected character %q at position %d", c, p.pos)
+	}
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Histogram assembles SignalFX streams into a Prometheus histogram. Bucket
+// datapoints carry their upper bound in a dimension, a property or the
+// publish label in sf_streamLabel.
+type Histogram struct {
+	BucketLabel  string   `yaml:"bucketLabel"`
+	Buckets      []string `yaml:"buckets"`
+	SumStream    string   `yaml:"sumStream"`
+	CountStream  string   `yaml:"countStream"`
+	bucketBounds []float64
+}
+
+func (h *Histogram) Validate() error {
+	if h.BucketLabel == "" {
+		h.BucketLabel = "le"
+	}
+	if len(h.Buckets) == 0 {
+		return fmt.Errorf("Histogram buckets must not be empty")
+	}
+	h.bucketBounds = make([]float64, 0, len(h.Buckets)+1)
+	hasInf := false
+	for _, bucket := range h.Buckets {
+		bound, err := ParseBucketBound(bucket)
+		if err != nil {
+			return err
+		}
+		hasInf = hasInf || math.IsInf(bound, +1)
+		h.bucketBounds = append(h.bucketBounds, bound)
+	}
+	if !hasInf {
+		h.bucketBounds = append(h.bucketBounds, math.Inf(+1))
+	}
+	sort.Float64s(h.bucketBounds)
+	if h.SumStream != "" && h.SumStream == h.CountStream {
+		return fmt.Errorf("Histogram sumStream and countStream must differ")
+	}
+	return nil
+}
+
+// ParseBucketBound parses the upper bound of a histogram bucket
+func ParseBucketBound(bound string) (float64, error) {
+	value, err := strconv.ParseFloat(bound, 64)
+	if err != nil || math.IsNaN(value) {
+		return 0, fmt.Errorf("Invalid histogram bucket bound %s", bound)
+	}
+	return value, nil
+}
+
+// BucketBounds returns the sorted upper bounds of all buckets that must be
+// present for a histogram to be complete. It always contains +Inf.
+func (h *Histogram) BucketBounds() []float64 {
+	return h.bucketBounds
+}
+
+// HasBucket reports whether a bucket with the upper bound is declared
+func (h *Histogram) HasBucket(bound float64) bool {
+	i := sort.SearchFloat64s(h.bucketBounds, bound)
+	return i < len(h.bucketBounds) && h.bucketBounds[i] == bound
+}
+
+// PartForStream returns the histogram part the datapoints of a stream
+// contribute to. Datapoints of all streams other than the sum and count
+// stream are buckets.
+func (h *Histogram) PartForStream(stream string) StreamPart {
+	return partForStream(stream, h.SumStream, h.CountStream)
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Matcher selects datapoints by the value of a SignalFX dimension or
+// property. Missing dimensions match as empty string.
+type Matcher struct {
+	Name  string  `yaml:"name"`
+	Value *string `yaml:"value"`
+	Regex string  `yaml:"regex"`
+	regex *regexp.Regexp
+}
+
+func (m *Matcher) Validate() error {
+	if m.Name == "" {
+		return fmt.Errorf("Matcher requires a name")
+	}
+	if (m.Value == nil) == (m.Regex == "") {
+		return fmt.Errorf("Matcher for %s requires either a value or a regex", m.Name)
+	}
+	if m.Regex != "" {
+		regexes, err := compileAnchored([]string{m.Regex})
+		if err != nil {
+			return err
+		}
+		m.regex = regexes[0]
+	}
+	return nil
+}
+
+func (m *Matcher) matches(value string) bool {
+	if m.regex != nil {
+		return m.regex.MatchString(value)
+	}
+	return value == *m.Value
+}
+
+// matcherNameRegex restricts the names of parsed matchers to SignalFX
+// dimension and property keys
+var matcherNameRegex = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_.-]*$")
+
+// ParseMatcher parses a matcher in the form name=value or name=~regex
+func ParseMatcher(s string) (Matcher, error) {
+	var m Matcher
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return m, fmt.Errorf("Invalid matcher %s, expected name=value or name=~regex", s)
+	}
+	name, rest := s[:i], s[i+1:]
+	if strings.HasSuffix(name, "!") {
+		return m, fmt.Errorf("Invalid matcher %s, negative matchers are not supported", s)
+	}
+	if !matcherNameRegex.MatchString(name) {
+		return m, fmt.Errorf("Invalid matcher %s, %q is not a dimension name", s, name)
+	}
+	if strings.HasPrefix(rest, "~") {
+		m = Matcher{Name: name, Regex: rest[1:]}
+	} else {
+		m = Matcher{Name: name, Value: &rest}
+	}
+	return m, m.Validate()
+}
+
+// MatchAll checks if all matchers match the dimensions and internal
+// properties of a datapoint
+func MatchAll(matchers []Matcher, dimensions map[string]string, properties map[string]interface{}) bool {
+	for i := range matchers {
+		m := &matchers[i]
+		value, ok := dimensions[m.Name]
+		if !ok {
+			if property, ok := properties[m.Name]; ok && property != nil {
+				value = fmt.Sprintf("%v", property)
+			}
+		}
+		if !m.matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches checks if all matchers of the template match the dimensions and
+// internal properties of a datapoint. Templates without matchers match every
+// datapoint.
+func (pm *PrometheusMetric) Matches(dimensions map[string]string, properties map[string]interface{}) bool {
+	return MatchAll(pm.Match, dimensions, properties)
+}
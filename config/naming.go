@@ -0,0 +1,123 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	NamingModeSanitize = "sanitize"
+	NamingModeReject   = "reject"
+)
+
+// NamingViolation describes why a rendered metric or label name does not
+// adhere to the Prometheus data model or naming conventions
+type NamingViolation string
+
+const (
+	InvalidMetricName    NamingViolation = "invalid_metric_name"
+	InvalidLabelName     NamingViolation = "invalid_label_name"
+	MissingCounterSuffix NamingViolation = "missing_counter_suffix"
+)
+
+var (
+	metricNameRegex   = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
+	labelNameRegex    = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+	invalidMetricRune = regexp.MustCompile("[^a-zA-Z0-9_:]")
+	invalidLabelRune  = regexp.MustCompile("[^a-zA-Z0-9_]")
+	unitRegex         = regexp.MustCompile("^[a-z][a-z0-9_]*$")
+)
+
+// IsValidMetricName checks a metric name against the Prometheus data model
+func IsValidMetricName(name string) bool {
+	return metricNameRegex.MatchString(name)
+}
+
+// IsValidLabelName checks a label name against the Prometheus data model.
+// Label names starting with __ are reserved for internal use.
+func IsValidLabelName(name string) bool {
+	return labelNameRegex.MatchString(name) && !strings.HasPrefix(name, "__")
+}
+
+// SanitizeMetricName turns an arbitrary string into a valid Prometheus metric
+// name by replacing invalid characters with underscores
+func SanitizeMetricName(name string) string {
+	name = invalidMetricRune.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// SanitizeLabelName turns an arbitrary string into a valid Prometheus label
+// name by replacing invalid characters with underscores
+func SanitizeLabelName(name string) string {
+	name = invalidLabelRune.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	for strings.HasPrefix(name, "__") {
+		name = name[1:]
+	}
+	return name
+}
+
+// Naming declares how rendered metric and label names that violate the
+// Prometheus data model or naming conventions are handled
+type Naming struct {
+	Mode                 string `yaml:"mode"`
+	EnforceCounterSuffix bool   `yaml:"enforceCounterSuffix"`
+}
+
+func (n *Naming) Validate() error {
+	if n.Mode == "" {
+		n.Mode = NamingModeSanitize
+	}
+	if n.Mode != NamingModeSanitize && n.Mode != NamingModeReject {
+		return fmt.Errorf("Unknown naming mode %s", n.Mode)
+	}
+	return nil
+}
+
+// Apply checks a rendered metric name and its labels. All found violations
+// are returned. In sanitize mode the names are fixed, in reject mode an error
+// is returned when any violation was found.
+func (n *Naming) Apply(metricType string, name string, labels map[string]string) (string, map[string]string, []NamingViolation, error) {
+	violations := []NamingViolation{}
+	renderedName := name
+
+	if !IsValidMetricName(name) {
+		violations = append(violations, InvalidMetricName)
+		name = SanitizeMetricName(name)
+	}
+	if n.EnforceCounterSuffix && metricType == "counter" && !strings.HasSuffix(name, "_total") {
+		violations = append(violations, MissingCounterSuffix)
+		name = name + "_total"
+	}
+
+	sanitizedLabels := make(map[string]string, len(labels))
+	invalidLabelNames := []string{}
+	for labelName := range labels {
+		if IsValidLabelName(labelName) {
+			sanitizedLabels[labelName] = labels[labelName]
+		} else {
+			invalidLabelNames = append(invalidLabelNames, labelName)
+		}
+	}
+	if len(invalidLabelNames) > 0 {
+		violations = append(violations, InvalidLabelName)
+	}
+	for _, labelName := range invalidLabelNames {
+		sanitizedName := SanitizeLabelName(labelName)
+		if _, exists := sanitizedLabels[sanitizedName]; exists {
+			return "", nil, violations, fmt.Errorf("Label %s of metric %s collides with label %s after sanitization", labelName, name, sanitizedName)
+		}
+		sanitizedLabels[sanitizedName] = labels[labelName]
+	}
+
+	if n.Mode == NamingModeReject && len(violations) > 0 {
+		return "", nil, violations, fmt.Errorf("Metric %s violates naming rules %v", renderedName, violations)
+	}
+	return name, sanitizedLabels, violations, nil
+}
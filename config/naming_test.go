@@ -0,0 +1,72 @@
+package config_test
+
+import (
+	"signalfx-prometheus-exporter/config"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamingSanitize(t *testing.T) {
+	naming := config.Naming{}
+	assert.Nil(t, naming.Validate())
+
+	name, labels, violations, err := naming.Apply("gauge", "1st-metric name", map[string]string{
+		"test-name": "a",
+		"__meta":    "b",
+		"valid":     "c",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "_1st_metric_name", name)
+	assert.Equal(t, map[string]string{"test_name": "a", "_meta": "b", "valid": "c"}, labels)
+	assert.Equal(t, []config.NamingViolation{config.InvalidMetricName, config.InvalidLabelName}, violations)
+}
+
+func TestNamingReject(t *testing.T) {
+	naming := config.Naming{Mode: config.NamingModeReject}
+	assert.Nil(t, naming.Validate())
+
+	_, _, violations, err := naming.Apply("gauge", "metric-name", map[string]string{})
+	assert.NotNil(t, err)
+	assert.Equal(t, []config.NamingViolation{config.InvalidMetricName}, violations)
+
+	name, _, violations, err := naming.Apply("gauge", "metric_name", map[string]string{"label": "a"})
+	assert.Nil(t, err)
+	assert.Equal(t, "metric_name", name)
+	assert.Empty(t, violations)
+}
+
+func TestNamingCounterSuffix(t *testing.T) {
+	naming := config.Naming{EnforceCounterSuffix: true}
+	assert.Nil(t, naming.Validate())
+
+	name, _, violations, err := naming.Apply("counter", "requests", map[string]string{})
+	assert.Nil(t, err)
+	assert.Equal(t, "requests_total", name)
+	assert.Equal(t, []config.NamingViolation{config.MissingCounterSuffix}, violations)
+
+	name, _, violations, err = naming.Apply("gauge", "requests", map[string]string{})
+	assert.Nil(t, err)
+	assert.Equal(t, "requests", name)
+	assert.Empty(t, violations)
+}
+
+func TestNamingLabelCollision(t *testing.T) {
+	naming := config.Naming{}
+	assert.Nil(t, naming.Validate())
+
+	_, _, _, err := naming.Apply("gauge", "metric", map[string]string{"a-b": "1", "a_b": "2"})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "collides")
+}
+
+func TestNamingUnknownMode(t *testing.T) {
+	configFile := `---
+naming:
+  mode: ignore
+flows: []
+`
+	_, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Unknown naming mode")
+}
@@ -0,0 +1,37 @@
+package config
+
+import "fmt"
+
+const (
+	DropPolicyBlock  = "block"
+	DropPolicyOldest = "oldest"
+	DropPolicyNewest = "newest"
+
+	defaultQueueSize = 10000
+)
+
+// Queue declares the bounded queue between receiving datapoints from
+// SignalFlow and applying them to the store, and what happens to datapoints
+// when it is full
+type Queue struct {
+	Size       int    `yaml:"size"`
+	DropPolicy string `yaml:"dropPolicy"`
+}
+
+func (q *Queue) Validate() error {
+	if q.Size == 0 {
+		q.Size = defaultQueueSize
+	}
+	if q.Size < 0 {
+		return fmt.Errorf("Queue size must not be negative")
+	}
+	if q.DropPolicy == "" {
+		q.DropPolicy = DropPolicyBlock
+	}
+	switch q.DropPolicy {
+	case DropPolicyBlock, DropPolicyOldest, DropPolicyNewest:
+	default:
+		return fmt.Errorf("Unknown queue drop policy %s", q.DropPolicy)
+	}
+	return nil
+}
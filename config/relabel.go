@@ -0,0 +1,158 @@
+package config
+
+import (
+	"crypto/md5"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	RelabelReplace   = "replace"
+	RelabelKeep      = "keep"
+	RelabelDrop      = "drop"
+	RelabelHashMod   = "hashmod"
+	RelabelLabelMap  = "labelmap"
+	RelabelLabelDrop = "labeldrop"
+	RelabelLabelKeep = "labelkeep"
+)
+
+// MetricNameLabel holds the metric name during relabeling
+const MetricNameLabel = "__name__"
+
+// RelabelConfig follows the semantics of the Prometheus relabel_config
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"sourceLabels"`
+	Separator    string   `yaml:"separator"`
+	Regex        string   `yaml:"regex"`
+	Modulus      uint64   `yaml:"modulus"`
+	TargetLabel  string   `yaml:"targetLabel"`
+	Replacement  string   `yaml:"replacement"`
+	Action       string   `yaml:"action"`
+	regex        *regexp.Regexp
+}
+
+func (rc *RelabelConfig) UnmarshalYAML(value *yaml.Node) error {
+	// defaults as documented for prometheus relabel_config
+	type plain RelabelConfig
+	*rc = RelabelConfig{
+		Separator:   ";",
+		Regex:       "(.*)",
+		Replacement: "$1",
+		Action:      RelabelReplace,
+	}
+	return value.Decode((*plain)(rc))
+}
+
+func (rc *RelabelConfig) Validate() error {
+	regexes, err := compileAnchored([]string{rc.Regex})
+	if err != nil {
+		return err
+	}
+	rc.regex = regexes[0]
+
+	switch rc.Action {
+	case RelabelReplace:
+		if rc.TargetLabel == "" {
+			return fmt.Errorf("Relabel action %s requires a targetLabel", rc.Action)
+		}
+		if !strings.Contains(rc.TargetLabel, "$") && !labelNameRegex.MatchString(rc.TargetLabel) {
+			return fmt.Errorf("Invalid relabel targetLabel %s", rc.TargetLabel)
+		}
+	case RelabelHashMod:
+		if rc.TargetLabel == "" {
+			return fmt.Errorf("Relabel action %s requires a targetLabel", rc.Action)
+		}
+		if rc.Modulus == 0 {
+			return fmt.Errorf("Relabel action %s requires a modulus", rc.Action)
+		}
+	case RelabelKeep, RelabelDrop, RelabelLabelMap, RelabelLabelDrop, RelabelLabelKeep:
+	default:
+		return fmt.Errorf("Unknown relabel action %s", rc.Action)
+	}
+	return nil
+}
+
+// Relabel applies relabel configs in order to a label set. The metric name is
+// available as the __name__ label. The returned label set is nil when the
+// series has been dropped.
+func Relabel(labels map[string]string, configs []RelabelConfig) map[string]string {
+	for i := range configs {
+		if labels = configs[i].apply(labels); labels == nil {
+			return nil
+		}
+	}
+	return labels
+}
+
+func (rc *RelabelConfig) apply(labels map[string]string) map[string]string {
+	values := make([]string, len(rc.SourceLabels))
+	for i, sourceLabel := range rc.SourceLabels {
+		values[i] = labels[sourceLabel]
+	}
+	val := strings.Join(values, rc.Separator)
+
+	switch rc.Action {
+	case RelabelKeep:
+		if !rc.regex.MatchString(val) {
+			return nil
+		}
+	case RelabelDrop:
+		if rc.regex.MatchString(val) {
+			return nil
+		}
+	case RelabelReplace:
+		indexes := rc.regex.FindStringSubmatchIndex(val)
+		if indexes == nil {
+			break
+		}
+		target := string(rc.regex.ExpandString([]byte{}, rc.TargetLabel, val, indexes))
+		if !labelNameRegex.MatchString(target) {
+			break
+		}
+		res := string(rc.regex.ExpandString([]byte{}, rc.Replacement, val, indexes))
+		if len(res) == 0 {
+			delete(labels, target)
+			break
+		}
+		labels[target] = res
+	case RelabelHashMod:
+		labels[rc.TargetLabel] = fmt.Sprintf("%d", sum64(md5.Sum([]byte(val)))%rc.Modulus)
+	case RelabelLabelMap:
+		mapped := make(map[string]string, len(labels))
+		for name, value := range labels {
+			mapped[name] = value
+		}
+		for name, value := range labels {
+			if rc.regex.MatchString(name) {
+				mapped[rc.regex.ReplaceAllString(name, rc.Replacement)] = value
+			}
+		}
+		labels = mapped
+	case RelabelLabelDrop:
+		for name := range labels {
+			if rc.regex.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+	case RelabelLabelKeep:
+		for name := range labels {
+			if !rc.regex.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+	}
+	return labels
+}
+
+// sum64 sums the md5 hash to an uint64 the same way prometheus does
+func sum64(hash [md5.Size]byte) uint64 {
+	var s uint64
+	for i, b := range hash {
+		shift := uint64((md5.Size - 1 - i) * 8)
+		s |= uint64(b) << shift
+	}
+	return s
+}
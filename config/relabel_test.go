@@ -0,0 +1,94 @@
+package config_test
+
+import (
+	"signalfx-prometheus-exporter/config"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func loadRelabelConfigs(t *testing.T, configYaml string) []config.RelabelConfig {
+	var configs []config.RelabelConfig
+	assert.Nil(t, yaml.Unmarshal([]byte(configYaml), &configs))
+	for i := range configs {
+		assert.Nil(t, configs[i].Validate())
+	}
+	return configs
+}
+
+func TestRelabelReplace(t *testing.T) {
+	configs := loadRelabelConfigs(t, `
+- sourceLabels: [__name__, env]
+  regex: 'catchpoint_(.*);(prod|stage)'
+  targetLabel: check
+  replacement: '$2-$1'
+- sourceLabels: [env]
+  regex: stage
+  targetLabel: env
+  replacement: ''
+`)
+	labels := config.Relabel(map[string]string{"__name__": "catchpoint_failures", "env": "stage"}, configs)
+	assert.Equal(t, map[string]string{"__name__": "catchpoint_failures", "check": "stage-failures"}, labels)
+}
+
+func TestRelabelKeepDrop(t *testing.T) {
+	configs := loadRelabelConfigs(t, `
+- sourceLabels: [env]
+  regex: prod|stage
+  action: keep
+- sourceLabels: [instance]
+  regex: 'test-.*'
+  action: drop
+`)
+	assert.Nil(t, config.Relabel(map[string]string{"env": "dev", "instance": "a"}, configs))
+	assert.Nil(t, config.Relabel(map[string]string{"env": "prod", "instance": "test-a"}, configs))
+	assert.NotNil(t, config.Relabel(map[string]string{"env": "prod", "instance": "a"}, configs))
+}
+
+func TestRelabelHashMod(t *testing.T) {
+	configs := loadRelabelConfigs(t, `
+- sourceLabels: [instance]
+  modulus: 4
+  targetLabel: shard
+  action: hashmod
+`)
+	labels := config.Relabel(map[string]string{"instance": "a"}, configs)
+	shard := labels["shard"]
+	assert.Contains(t, []string{"0", "1", "2", "3"}, shard)
+
+	labels = config.Relabel(map[string]string{"instance": "a"}, configs)
+	assert.Equal(t, shard, labels["shard"])
+}
+
+func TestRelabelLabelActions(t *testing.T) {
+	configs := loadRelabelConfigs(t, `
+- regex: 'cp_(.*)'
+  action: labelmap
+- regex: 'cp_.*'
+  action: labeldrop
+- regex: '__name__|test.*'
+  action: labelkeep
+`)
+	labels := config.Relabel(map[string]string{
+		"__name__":    "metric",
+		"cp_testname": "a",
+		"cp_owner":    "b",
+	}, configs)
+	assert.Equal(t, map[string]string{"__name__": "metric", "testname": "a"}, labels)
+}
+
+func TestRelabelValidation(t *testing.T) {
+	var configs []config.RelabelConfig
+	assert.Nil(t, yaml.Unmarshal([]byte(`
+- action: hashmod
+  targetLabel: shard
+- action: replace
+- action: unknown
+- regex: '('
+  action: drop
+`), &configs))
+	for _, rc := range configs {
+		assert.NotNil(t, rc.Validate())
+	}
+}
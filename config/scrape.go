@@ -0,0 +1,48 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const (
+	ErrorHandlingFail     = "fail"
+	ErrorHandlingContinue = "continue"
+)
+
+// pathSegmentRegex restricts flow and scrape group names to characters that
+// are safe in an URL path
+var pathSegmentRegex = regexp.MustCompile("^[a-zA-Z0-9_.-]+$")
+
+// ScrapeGroups returns the names of the flows of each scrape group
+func (c *Config) ScrapeGroups() map[string][]string {
+	groups := make(map[string][]string)
+	for _, fp := range c.Flows {
+		if fp.ScrapeGroup != "" {
+			groups[fp.ScrapeGroup] = append(groups[fp.ScrapeGroup], fp.Name)
+		}
+	}
+	return groups
+}
+
+// ScrapeOptions declares how a scrape endpoint negotiates the exposition
+// format and how it handles errors while gathering metrics
+type ScrapeOptions struct {
+	OpenMetrics          bool   `yaml:"openMetrics"`
+	DisableCompression   bool   `yaml:"disableCompression"`
+	MaxConcurrentScrapes int    `yaml:"maxConcurrentScrapes"`
+	ErrorHandling        string `yaml:"errorHandling"`
+}
+
+func (so *ScrapeOptions) Validate() error {
+	if so.ErrorHandling == "" {
+		so.ErrorHandling = ErrorHandlingFail
+	}
+	if so.ErrorHandling != ErrorHandlingFail && so.ErrorHandling != ErrorHandlingContinue {
+		return fmt.Errorf("Unknown error handling %s", so.ErrorHandling)
+	}
+	if so.MaxConcurrentScrapes < 0 {
+		return fmt.Errorf("maxConcurrentScrapes must not be negative")
+	}
+	return nil
+}
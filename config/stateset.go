@@ -0,0 +1,59 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// StateSet maps numeric datapoint values to named states. Every state is
+// exposed as its own series with a value of 1 for the current state and 0
+// for all others.
+type StateSet struct {
+	Label        string            `yaml:"label"`
+	States       map[string]string `yaml:"states"`
+	stateByValue map[float64]string
+	stateNames   []string
+}
+
+func (ss *StateSet) Validate() error {
+	if ss.Label == "" {
+		ss.Label = "state"
+	}
+	if !IsValidLabelName(ss.Label) {
+		return fmt.Errorf("Invalid state label name %s", ss.Label)
+	}
+	if len(ss.States) == 0 {
+		return fmt.Errorf("State set requires at least one state")
+	}
+	ss.stateByValue = make(map[float64]string, len(ss.States))
+	uniqueNames := make(map[string]bool, len(ss.States))
+	for value, state := range ss.States {
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid state value %s", value)
+		}
+		if state == "" {
+			return fmt.Errorf("State for value %s must not be empty", value)
+		}
+		ss.stateByValue[number] = state
+		uniqueNames[state] = true
+	}
+	ss.stateNames = make([]string, 0, len(uniqueNames))
+	for state := range uniqueNames {
+		ss.stateNames = append(ss.stateNames, state)
+	}
+	sort.Strings(ss.stateNames)
+	return nil
+}
+
+// StateForValue returns the state a datapoint value maps to
+func (ss *StateSet) StateForValue(value float64) (string, bool) {
+	state, ok := ss.stateByValue[value]
+	return state, ok
+}
+
+// StateNames returns all distinct states in a stable order
+func (ss *StateSet) StateNames() []string {
+	return ss.stateNames
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+)
+
+// StreamPart identifies which part of a histogram or summary a datapoint
+// contributes to
+type StreamPart int
+
+const (
+	// ValuePart is a bucket of a histogram or a quantile of a summary
+	ValuePart StreamPart = iota
+	SumPart
+	CountPart
+)
+
+func partForStream(stream string, sumStream string, countStream string) StreamPart {
+	switch {
+	case stream != "" && stream == sumStream:
+		return SumPart
+	case stream != "" && stream == countStream:
+		return CountPart
+	default:
+		return ValuePart
+	}
+}
+
+// Summary assembles SignalFX percentile streams into a Prometheus summary.
+// Each quantile is published by its own stream.
+type Summary struct {
+	Quantiles   map[string]float64 `yaml:"quantiles"`
+	SumStream   string             `yaml:"sumStream"`
+	CountStream string             `yaml:"countStream"`
+}
+
+func (s *Summary) Validate() error {
+	if len(s.Quantiles) == 0 {
+		return fmt.Errorf("Summary requires at least one quantile stream")
+	}
+	for stream, quantile := range s.Quantiles {
+		if quantile < 0 || quantile > 1 {
+			return fmt.Errorf("Quantile %v of stream %s is not between 0 and 1", quantile, stream)
+		}
+		if stream == s.SumStream || stream == s.CountStream {
+			return fmt.Errorf("Stream %s can't be used for a quantile and the sum or count", stream)
+		}
+	}
+	if s.SumStream != "" && s.SumStream == s.CountStream {
+		return fmt.Errorf("Summary sumStream and countStream must differ")
+	}
+	return nil
+}
+
+// Streams returns the quantile, sum and count streams of the summary
+func (s *Summary) Streams() []string {
+	streams := make([]string, 0, len(s.Quantiles)+2)
+	for stream := range s.Quantiles {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+	for _, stream := range []string{s.SumStream, s.CountStream} {
+		if stream != "" {
+			streams = append(streams, stream)
+		}
+	}
+	return streams
+}
+
+// PartForStream returns the summary part the datapoints of a stream
+// contribute to
+func (s *Summary) PartForStream(stream string) StreamPart {
+	return partForStream(stream, s.SumStream, s.CountStream)
+}
+
+// QuantileForStream returns the quantile published by a stream
+func (s *Summary) QuantileForStream(stream string) (float64, bool) {
+	quantile, ok := s.Quantiles[stream]
+	return quantile, ok
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"fmt"
+	"math"
+)
+
+// unitConversions maps named unit conversions to their multiplication factor
+var unitConversions = map[string]float64{
+	"ns_to_s":          1e-9,
+	"us_to_s":          1e-6,
+	"ms_to_s":          1e-3,
+	"min_to_s":         60,
+	"h_to_s":           3600,
+	"bits_to_bytes":    1.0 / 8,
+	"bytes_to_kib":     1.0 / 1024,
+	"bytes_to_mib":     1.0 / (1024 * 1024),
+	"bytes_to_gib":     1.0 / (1024 * 1024 * 1024),
+	"percent_to_ratio": 1e-2,
+}
+
+// ValueTransformation modifies a datapoint value before it is applied to a
+// Prometheus metric
+type ValueTransformation struct {
+	Convert    string   `yaml:"convert"`
+	Multiplier *float64 `yaml:"multiplier"`
+	Offset     float64  `yaml:"offset"`
+	Expression string   `yaml:"expression"`
+	Min        *float64 `yaml:"min"`
+	Max        *float64 `yaml:"max"`
+	DropNaN    bool     `yaml:"dropNaN"`
+	factor     float64
+	expression expression
+}
+
+func (vt *ValueTransformation) Validate() error {
+	vt.factor = 1
+	if vt.Convert != "" {
+		factor, ok := unitConversions[vt.Convert]
+		if !ok {
+			return fmt.Errorf("Unknown unit conversion %s", vt.Convert)
+		}
+		vt.factor = factor
+	}
+	if vt.Multiplier != nil {
+		vt.factor *= *vt.Multiplier
+	}
+	if vt.Expression != "" {
+		expr, err := compileExpression(vt.Expression)
+		if err != nil {
+			return fmt.Errorf("Invalid value expression %s - %+s", vt.Expression, err)
+		}
+		vt.expression = expr
+	}
+	if vt.Min != nil && vt.Max != nil && *vt.Min > *vt.Max {
+		return fmt.Errorf("Value min %v is greater than max %v", *vt.Min, *vt.Max)
+	}
+	return nil
+}
+
+// Apply transforms a value in the order unit conversion, multiplier, offset,
+// expression and clamping. The second return value is false when the value
+// should be dropped.
+func (vt *ValueTransformation) Apply(value float64) (float64, bool) {
+	value = value*vt.factor + vt.Offset
+	if vt.expression != nil {
+		value = vt.expression(value)
+	}
+	if vt.Min != nil {
+		value = math.Max(value, *vt.Min)
+	}
+	if vt.Max != nil {
+		value = math.Min(value, *vt.Max)
+	}
+	if vt.DropNaN && math.IsNaN(value) {
+		return value, false
+	}
+	return value, true
+}
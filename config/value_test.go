@@ -0,0 +1,92 @@
+package config_test
+
+import (
+	"math"
+	"signalfx-prometheus-exporter/config"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func loadValueTransformation(t *testing.T, valueYaml string) *config.PrometheusMetric {
+	configFile := `---
+flows:
+- name: catchpoint-data
+  query: data('catchpoint.responsetime').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    value:
+` + valueYaml
+	cfg, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+	mt, err := cfg.Flows[0].GetMetricTemplateForStream("default")
+	assert.Nil(t, err)
+	return &mt
+}
+
+func TestValueUnitConversion(t *testing.T) {
+	mt := loadValueTransformation(t, `
+      convert: ms_to_s
+      multiplier: 2
+      offset: 1
+`)
+	value, ok := mt.TransformValue(1500)
+	assert.True(t, ok)
+	assert.InDelta(t, 4.0, value, 1e-9)
+}
+
+func TestValueExpression(t *testing.T) {
+	mt := loadValueTransformation(t, `
+      convert: percent_to_ratio
+      expression: '1 - value'
+      min: 0
+      max: 0.5
+`)
+	value, ok := mt.TransformValue(80)
+	assert.True(t, ok)
+	assert.InDelta(t, 0.2, value, 1e-9)
+
+	value, _ = mt.TransformValue(10)
+	assert.Equal(t, 0.5, value)
+
+	value, _ = mt.TransformValue(120)
+	assert.Equal(t, 0.0, value)
+}
+
+func TestValueExpressionPrecedence(t *testing.T) {
+	mt := loadValueTransformation(t, `
+      expression: '-(value + 2) * 3 / 2 % 4 + 1.5e1'
+`)
+	value, _ := mt.TransformValue(2)
+	assert.InDelta(t, math.Mod(-12.0/2, 4)+15, value, 1e-9)
+}
+
+func TestValueDropNaN(t *testing.T) {
+	mt := loadValueTransformation(t, `
+      dropNaN: true
+`)
+	_, ok := mt.TransformValue(math.NaN())
+	assert.False(t, ok)
+	_, ok = mt.TransformValue(1)
+	assert.True(t, ok)
+}
+
+func TestValueWithoutTransformation(t *testing.T) {
+	mt := config.PrometheusMetric{}
+	value, ok := mt.TransformValue(42)
+	assert.True(t, ok)
+	assert.Equal(t, 42.0, value)
+}
+
+func TestValueValidation(t *testing.T) {
+	invalid := []config.ValueTransformation{
+		{Convert: "furlongs_to_m"},
+		{Expression: "value +"},
+		{Expression: "(value"},
+		{Expression: "rate(value)"},
+		{Min: &[]float64{2}[0], Max: &[]float64{1}[0]},
+	}
+	for _, vt := range invalid {
+		assert.NotNil(t, vt.Validate())
+	}
+}
@@ -0,0 +1,100 @@
+package serve
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"signalfx-prometheus-exporter/web"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	adminActionPause   = "pause"
+	adminActionResume  = "resume"
+	adminActionRestart = "restart"
+)
+
+// AdminActionResult is the outcome of an admin action on a flow
+type AdminActionResult struct {
+	Flow          string `json:"flow"`
+	Action        string `json:"action"`
+	ClearedSeries int    `json:"clearedSeries"`
+}
+
+// checkAdminAPI verifies that the web config of the observability server
+// enables authentication, the admin API is never served without it
+func checkAdminAPI(webConfigFile string) error {
+	if webConfigFile == "" {
+		return fmt.Errorf("the admin API requires an observability web config with authentication")
+	}
+	cfg, err := web.LoadConfig(webConfigFile)
+	if err != nil {
+		return err
+	}
+	if !cfg.AuthEnabled() {
+		return fmt.Errorf("the admin API requires authentication in the observability web config %s", webConfigFile)
+	}
+	return nil
+}
+
+// registerAdminAPI adds the admin API routes to the observability server
+func registerAdminAPI(router *mux.Router) {
+	admin := router.PathPrefix("/api/v1/admin").Subrouter()
+	admin.Use(web.RequireAuthentication)
+	admin.HandleFunc("/flows", flowsAPIHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/flows/{name}/{action:pause|resume|restart}", adminActionHandler).Methods(http.MethodPost)
+}
+
+// adminActionHandler pauses, resumes or restarts a flow. Pausing clears the
+// series of the flow when the clear parameter is set.
+func adminActionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, action := vars["name"], vars["action"]
+	runner, ok := runnerOf(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Flow %s does not exist", name), http.StatusNotFound)
+		return
+	}
+	clear := false
+	if value := r.URL.Query().Get("clear"); value != "" {
+		var err error
+		if clear, err = strconv.ParseBool(value); err != nil || action != adminActionPause {
+			http.Error(w, "The clear parameter is only supported by pause and must be a boolean", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var err error
+	switch action {
+	case adminActionPause:
+		err = runner.pause()
+	case adminActionResume:
+		err = runner.resume()
+	case adminActionRestart:
+		err = runner.restart()
+	}
+	if err != nil {
+		log.Printf("Flow %s %s requested by %s failed - %+s\n", name, action, r.RemoteAddr, err)
+		http.Error(w, fmt.Sprintf("Flow %s can't %s - %+s", name, action, err), http.StatusConflict)
+		return
+	}
+	result := AdminActionResult{Flow: name, Action: action}
+	if clear {
+		result.ClearedSeries = sfxStore.clearFlow(name)
+	}
+	flowAdminActions.WithLabelValues(name, action).Inc()
+	log.Printf("Flow %s %s requested by %s, %d series cleared\n", name, action, r.RemoteAddr, result.ClearedSeries)
+
+	w.Header().Set("Content-Type", "application/json")
+	response := struct {
+		Status string            `json:"status"`
+		Data   AdminActionResult `json:"data"`
+	}{Status: "success", Data: result}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Failed to render admin API response - %+s\n", err)
+	}
+}
@@ -0,0 +1,123 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRunner returns a runner whose computation only reports its starts and
+// runs until it is stopped
+func fakeRunner(t *testing.T, name string) (*flowRunner, chan struct{}) {
+	_, fp := loadFlow(t, `---
+flows:
+- name: `+name+`
+  query: data('catchpoint.responsetime').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    name: catchpoint_response_time
+`)
+	runner := newFlowRunner(nil, fp)
+	started := make(chan struct{}, 10)
+	runner.stream = func(ctx context.Context) error {
+		started <- struct{}{}
+		<-ctx.Done()
+		return nil
+	}
+	return runner, started
+}
+
+func awaitStart(t *testing.T, started chan struct{}) {
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("flow was not started")
+	}
+}
+
+func TestFlowRunner(t *testing.T) {
+	runner, started := fakeRunner(t, "runner-flow")
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- runner.run(ctx) }()
+	awaitStart(t, started)
+
+	assert.Equal(t, errFlowNotPaused, runner.resume())
+	restarts := runner.status.snapshot(nil).Restarts
+	assert.Nil(t, runner.restart())
+	awaitStart(t, started)
+	assert.Equal(t, restarts+1, runner.status.snapshot(nil).Restarts)
+
+	assert.Nil(t, runner.pause())
+	assert.Equal(t, flowStatePaused, runner.status.snapshot(nil).State)
+	assert.Equal(t, errFlowPaused, runner.pause())
+	assert.Equal(t, errFlowPaused, runner.restart())
+	assert.Len(t, started, 0)
+
+	assert.Nil(t, runner.resume())
+	awaitStart(t, started)
+
+	cancel()
+	assert.Nil(t, <-stopped)
+}
+
+func TestAdminActionHandler(t *testing.T) {
+	flowAdminActions = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "admin_actions"}, []string{"flow", "action"})
+	runner, started := fakeRunner(t, "admin-flow")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runner.run(ctx)
+	awaitStart(t, started)
+
+	owner := seriesOwner{flow: "admin-flow", template: "admin-flow/0"}
+	assert.Nil(t, sfxStore.setGauge(seriesMetadata{name: "admin_gauge", owner: owner}, 1))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/admin/flows/{name}/{action:pause|resume|restart}", adminActionHandler)
+	post := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, nil))
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotFound, post("/api/v1/admin/flows/unknown/pause").Code)
+	assert.Equal(t, http.StatusBadRequest, post("/api/v1/admin/flows/admin-flow/restart?clear=true").Code)
+	assert.Equal(t, http.StatusConflict, post("/api/v1/admin/flows/admin-flow/resume").Code)
+
+	w := post("/api/v1/admin/flows/admin-flow/pause?clear=true")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response struct {
+		Status string            `json:"status"`
+		Data   AdminActionResult `json:"data"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, AdminActionResult{Flow: "admin-flow", Action: adminActionPause, ClearedSeries: 1}, response.Data)
+	assert.Equal(t, 0, sfxStore.seriesByTemplate()["admin-flow/0"])
+
+	assert.Equal(t, http.StatusOK, post("/api/v1/admin/flows/admin-flow/resume").Code)
+	awaitStart(t, started)
+	assert.Equal(t, 1.0, testutil.ToFloat64(flowAdminActions.WithLabelValues("admin-flow", adminActionPause)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(flowAdminActions.WithLabelValues("admin-flow", adminActionResume)))
+}
+
+func TestCheckAdminAPI(t *testing.T) {
+	dir := t.TempDir()
+	withAuth := filepath.Join(dir, "auth.yml")
+	withoutAuth := filepath.Join(dir, "no-auth.yml")
+	assert.Nil(t, os.WriteFile(withAuth, []byte("bearer_tokens: [token-1]\n"), 0600))
+	assert.Nil(t, os.WriteFile(withoutAuth, []byte("http_server_config: {}\n"), 0600))
+
+	assert.Nil(t, checkAdminAPI(withAuth))
+	assert.NotNil(t, checkAdminAPI(withoutAuth))
+	assert.NotNil(t, checkAdminAPI(""))
+}
@@ -0,0 +1,117 @@
+package serve
+
+import (
+	"log"
+	"sync"
+
+	"signalfx-prometheus-exporter/config"
+
+	"github.com/signalfx/signalfx-go/idtool"
+	"github.com/signalfx/signalfx-go/signalflow/messages"
+)
+
+// renderedTemplate is a metric template rendered for the metadata of a time
+// series. The template carries the type that was derived for the series.
+type renderedTemplate struct {
+	template   config.PrometheusMetric
+	series     seriesMetadata
+	violations []config.NamingViolation
+	err        error
+}
+
+// renderedTimeSeries holds everything derived from the metadata of a time
+// series, so datapoints only need to be applied to the store
+type renderedTimeSeries struct {
+	meta      *messages.MetadataProperties
+	stream    string
+	templates []renderedTemplate
+}
+
+// renderCache holds the rendered time series of a flow by TSID. SignalFlow
+// replaces the metadata of a TSID when it changes, so an entry is valid as
+// long as it was rendered from the current metadata. Entries are removed when
+// SignalFlow expires their TSID.
+type renderCache struct {
+	cfg     *config.Config
+	fp      config.FlowProgram
+	mu      sync.Mutex
+	entries map[idtool.ID]*renderedTimeSeries
+}
+
+func newRenderCache(cfg *config.Config, fp config.FlowProgram) *renderCache {
+	return &renderCache{cfg: cfg, fp: fp, entries: make(map[idtool.ID]*renderedTimeSeries)}
+}
+
+// get returns the rendered time series for a TSID and renders it again when
+// the metadata changed
+func (rc *renderCache) get(tsid idtool.ID, meta *messages.MetadataProperties) *renderedTimeSeries {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	entry, ok := rc.entries[tsid]
+	if !ok || entry.meta != meta {
+		entry = renderTimeSeries(rc.cfg, rc.fp, tsid, meta)
+		rc.entries[tsid] = entry
+	}
+	return entry
+}
+
+// expire removes the rendered time series of a TSID that is no longer part of
+// the computation or whose series were evicted, and returns it
+func (rc *renderCache) expire(tsid idtool.ID) *renderedTimeSeries {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	entry := rc.entries[tsid]
+	delete(rc.entries, tsid)
+	return entry
+}
+
+// len returns the number of cached time series
+func (rc *renderCache) len() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return len(rc.entries)
+}
+
+// renderTimeSeries selects the metric templates for the metadata of a time
+// series and renders them
+func renderTimeSeries(cfg *config.Config, fp config.FlowProgram, tsid idtool.ID, meta *messages.MetadataProperties) *renderedTimeSeries {
+	stream, ok := meta.InternalProperties["sf_streamLabel"].(string)
+	if !ok {
+		stream = "default"
+	}
+	templates := fp.SelectMetricTemplates(stream, meta.CustomProperties, meta.InternalProperties)
+	rendered := &renderedTimeSeries{
+		meta:      meta,
+		stream:    stream,
+		templates: make([]renderedTemplate, len(templates)),
+	}
+	for i, mt := range templates {
+		rendered.templates[i] = renderTemplate(cfg, fp, mt, meta)
+		// rendering errors are cached with the time series, so they are
+		// logged once instead of for every datapoint
+		if err := rendered.templates[i].err; err != nil && err != errSeriesDropped {
+			log.Printf("Flow %s failed to render metric for stream %s - %+s\n", fp.Name, stream, err)
+		}
+		rendered.templates[i].series.source = &seriesSource{
+			flow:          fp.Name,
+			stream:        stream,
+			template:      mt.ID(),
+			templateIndex: mt.Index(),
+			tsid:          tsid,
+			dimensions:    meta.CustomProperties,
+		}
+	}
+	return rendered
+}
+
+func renderTemplate(cfg *config.Config, fp config.FlowProgram, mt config.PrometheusMetric, meta *messages.MetadataProperties) renderedTemplate {
+	// templates with the auto type are rendered with the type of the series
+	metricType, err := mt.MetricType(meta.InternalProperties)
+	if err != nil {
+		return renderedTemplate{template: mt, err: err}
+	}
+	mt.Type = metricType
+
+	series, violations, err := buildPrometheusMetadata(fp, mt, cfg.Naming, meta)
+	return renderedTemplate{template: mt, series: series, violations: violations, err: err}
+}
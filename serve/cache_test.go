@@ -0,0 +1,109 @@
+package serve
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/signalfx/signalfx-go/idtool"
+	"github.com/signalfx/signalfx-go/signalflow/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+const cacheFlow = `---
+flows:
+- name: catchpoint-data
+  query: data('catchpoint.responsetime').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    name: catchpoint_response_time
+    autoLabels: {}
+    labels:
+      instance: '{{ .SignalFxLabels.cp_testname }}'
+    relabelConfigs:
+    - sourceLabels: [cp_nodename]
+      targetLabel: node
+`
+
+func testMetadata(testName string) *messages.MetadataProperties {
+	return &messages.MetadataProperties{
+		OriginatingMetric: "catchpoint.responsetime",
+		InternalProperties: map[string]interface{}{
+			"sf_streamLabel": "default",
+		},
+		CustomProperties: map[string]string{
+			"cp_testname": testName,
+			"cp_nodename": "node-1",
+			"cp_testtype": "web",
+		},
+	}
+}
+
+func TestRenderCacheInvalidation(t *testing.T) {
+	cfg, fp := loadFlow(t, cacheFlow)
+	cache := newRenderCache(cfg, fp)
+
+	meta := testMetadata("test-a")
+	first := cache.get(idtool.ID(1), meta)
+	assert.Len(t, first.templates, 1)
+	assert.Nil(t, first.templates[0].err)
+	assert.Contains(t, first.templates[0].series.labelValues, "test-a")
+	assert.Same(t, first, cache.get(idtool.ID(1), meta))
+
+	// new metadata for the TSID replaces the rendered series
+	renamed := cache.get(idtool.ID(1), testMetadata("test-b"))
+	assert.NotSame(t, first, renamed)
+	assert.Contains(t, renamed.templates[0].series.labelValues, "test-b")
+
+	// other TSIDs are not affected
+	other := cache.get(idtool.ID(2), meta)
+	assert.NotSame(t, first, other)
+	assert.Same(t, renamed, cache.get(idtool.ID(1), renamed.meta))
+}
+
+func TestRenderCacheExpiration(t *testing.T) {
+	cfg, fp := loadFlow(t, cacheFlow)
+	cache := newRenderCache(cfg, fp)
+	meta := testMetadata("test-a")
+	first := cache.get(idtool.ID(1), meta)
+	cache.get(idtool.ID(2), meta)
+	assert.Equal(t, 2, cache.len())
+
+	cache.expire(idtool.ID(1))
+	assert.Equal(t, 1, cache.len())
+	// a TSID seen again after it expired is rendered again
+	assert.NotSame(t, first, cache.get(idtool.ID(1), meta))
+}
+
+func BenchmarkRenderUncached(b *testing.B) {
+	cfg, fp := loadFlow(b, cacheFlow)
+	store := newSeriesStore()
+	metas := make([]*messages.MetadataProperties, 1000)
+	for i := range metas {
+		metas[i] = testMetadata(fmt.Sprintf("test-%d", i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rendered := renderTimeSeries(cfg, fp, idtool.ID(i%len(metas)), metas[i%len(metas)])
+		if err := store.setGauge(rendered.templates[0].series, 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRenderCached(b *testing.B) {
+	cfg, fp := loadFlow(b, cacheFlow)
+	cache := newRenderCache(cfg, fp)
+	store := newSeriesStore()
+	metas := make([]*messages.MetadataProperties, 1000)
+	for i := range metas {
+		metas[i] = testMetadata(fmt.Sprintf("test-%d", i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tsid := i % len(metas)
+		rendered := cache.get(idtool.ID(tsid), metas[tsid])
+		if err := store.setGauge(rendered.templates[0].series, 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
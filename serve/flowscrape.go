@@ -0,0 +1,47 @@
+package serve
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// flowCollector exposes the series of some flows of a store, so flows can be
+// scraped on their own endpoints
+type flowCollector struct {
+	store *seriesStore
+	flows map[string]bool
+}
+
+func (fc *flowCollector) Describe(ch chan<- *prometheus.Desc) {
+	// unchecked collector
+}
+
+func (fc *flowCollector) Collect(ch chan<- prometheus.Metric) {
+	fc.store.collect(ch, fc.flows)
+}
+
+// newFlowsGatherer returns a gatherer for the series of the flows
+func newFlowsGatherer(store *seriesStore, flows ...string) prometheus.Gatherer {
+	fc := &flowCollector{store: store, flows: make(map[string]bool, len(flows))}
+	for _, flow := range flows {
+		fc.flows[flow] = true
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(fc)
+	return &UnitRegistry{Registry: registry, Store: store}
+}
+
+// flowsMetricsHandler serves the series of the flow or scrape group named in
+// the request path
+func flowsMetricsHandler(endpoint *scrapeEndpoint, gatherers map[string]prometheus.Gatherer, kind string, w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	g, ok := gatherers[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("%s %s does not exist", kind, name), http.StatusNotFound)
+		return
+	}
+	endpoint.serveGatherer(g, w, r)
+}
@@ -0,0 +1,55 @@
+package serve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"signalfx-prometheus-exporter/config"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlowsGatherer(t *testing.T) {
+	store := newSeriesStore()
+	for _, flow := range []string{"flow-a", "flow-b", "flow-c"} {
+		meta := seriesMetadata{
+			name:        "some_gauge",
+			labelNames:  []string{"flow"},
+			labelValues: []string{flow},
+			owner:       seriesOwner{flow: flow, template: flow + "/0"},
+		}
+		assert.Nil(t, store.setGauge(meta, 1))
+	}
+
+	count, err := testutil.GatherAndCount(newFlowsGatherer(store, "flow-a"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	count, err = testutil.GatherAndCount(newFlowsGatherer(store, "flow-a", "flow-c"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	count, err = testutil.GatherAndCount(newFlowsGatherer(store))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	endpoint := newScrapeEndpoint(config.ScrapeOptions{})
+	gatherers := map[string]prometheus.Gatherer{"flow-b": newFlowsGatherer(store, "flow-b")}
+	router := mux.NewRouter()
+	router.HandleFunc("/metrics/flow/{name}", func(w http.ResponseWriter, r *http.Request) {
+		flowsMetricsHandler(endpoint, gatherers, "Flow", w, r)
+	})
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	w := get("/metrics/flow/flow-b")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `some_gauge{flow="flow-b"} 1`)
+	assert.NotContains(t, w.Body.String(), `flow-a`)
+	assert.Equal(t, http.StatusNotFound, get("/metrics/flow/flow-a").Code)
+}
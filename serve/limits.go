@@ -0,0 +1,95 @@
+package serve
+
+import "fmt"
+
+const (
+	limitGlobal   = "global"
+	limitFlow     = "flow"
+	limitTemplate = "template"
+)
+
+// seriesOwner identifies the flow and metric template that created a series,
+// along with their series limits. A limit of 0 means no limit.
+type seriesOwner struct {
+	flow              string
+	flowMaxSeries     int
+	flowMemoryBudget  int64
+	template          string
+	templateMaxSeries int
+}
+
+// seriesLimitError rejects a new series because a series limit was reached.
+// Existing series keep being updated.
+type seriesLimitError struct {
+	limit string
+	max   int
+	owner seriesOwner
+	// first is set for the first rejection since the limit was reached
+	first bool
+}
+
+func (e *seriesLimitError) Error() string {
+	switch e.limit {
+	case limitFlow:
+		return fmt.Sprintf("Series limit of %d reached for flow %s", e.max, e.owner.flow)
+	case limitTemplate:
+		return fmt.Sprintf("Series limit of %d reached for template %s of flow %s", e.max, e.owner.template, e.owner.flow)
+	default:
+		return fmt.Sprintf("Global series limit of %d reached by flow %s", e.max, e.owner.flow)
+	}
+}
+
+// seriesCounts tracks the number of series in the store globally, per flow
+// and per template to enforce series limits
+type seriesCounts struct {
+	maxSeries  int
+	total      int
+	byFlow     map[string]int
+	byTemplate map[string]int
+	// limits that rejected series since they were reached, by limit and owner
+	limitsHit map[string]bool
+}
+
+func newSeriesCounts() seriesCounts {
+	return seriesCounts{
+		byFlow:     make(map[string]int),
+		byTemplate: make(map[string]int),
+		limitsHit:  make(map[string]bool),
+	}
+}
+
+// admit checks if the owner may create another series
+func (sc *seriesCounts) admit(owner seriesOwner) error {
+	checks := []struct {
+		limit string
+		key   string
+		count int
+		max   int
+	}{
+		{limitGlobal, limitGlobal, sc.total, sc.maxSeries},
+		{limitFlow, owner.flow, sc.byFlow[owner.flow], owner.flowMaxSeries},
+		{limitTemplate, owner.template, sc.byTemplate[owner.template], owner.templateMaxSeries},
+	}
+	for _, c := range checks {
+		hitKey := c.limit + "/" + c.key
+		if c.max > 0 && c.count >= c.max {
+			first := !sc.limitsHit[hitKey]
+			sc.limitsHit[hitKey] = true
+			return &seriesLimitError{limit: c.limit, max: c.max, owner: owner, first: first}
+		}
+		delete(sc.limitsHit, hitKey)
+	}
+	return nil
+}
+
+func (sc *seriesCounts) add(owner seriesOwner) {
+	sc.total++
+	sc.byFlow[owner.flow]++
+	sc.byTemplate[owner.template]++
+}
+
+func (sc *seriesCounts) remove(owner seriesOwner) {
+	sc.total--
+	sc.byFlow[owner.flow]--
+	sc.byTemplate[owner.template]--
+}
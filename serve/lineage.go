@@ -0,0 +1,175 @@
+package serve
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/signalfx/signalfx-go/idtool"
+)
+
+// sourceBytes approximates the memory held by the source of a series
+const sourceBytes = 64
+
+// seriesSource is the SignalFx time series, flow and template that produced
+// a series. Sources are shared by all datapoints of a TSID.
+type seriesSource struct {
+	flow          string
+	stream        string
+	template      string
+	templateIndex int
+	tsid          idtool.ID
+	dimensions    map[string]string
+}
+
+// addSource records the source of a datapoint applied to a series. Must be
+// called with the lock held.
+func (s *seriesStore) addSource(ser *series, source *seriesSource) {
+	if source == nil || ser.sources[source.tsid] == source {
+		return
+	}
+	if ser.sources == nil {
+		ser.sources = make(map[idtool.ID]*seriesSource)
+	}
+	if _, ok := ser.sources[source.tsid]; !ok {
+		s.grow(ser, sourceBytes)
+	}
+	ser.sources[source.tsid] = source
+}
+
+// removeSources removes an expired TSID from the sources of the series it was
+// rendered to
+func (s *seriesStore) removeSources(tsid idtool.ID, rendered *renderedTimeSeries) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rt := range rendered.templates {
+		if rt.err != nil {
+			continue
+		}
+		family, ok := s.families[rt.series.name]
+		if !ok {
+			continue
+		}
+		ser, ok := family.series[rt.series.key]
+		if !ok {
+			continue
+		}
+		if _, ok := ser.sources[tsid]; ok {
+			delete(ser.sources, tsid)
+			s.grow(ser, -sourceBytes)
+		}
+	}
+}
+
+// SeriesSource is the origin of an exported series in the lineage API
+type SeriesSource struct {
+	Flow          string            `json:"flow"`
+	Stream        string            `json:"stream"`
+	Template      string            `json:"template"`
+	TemplateIndex int               `json:"templateIndex"`
+	TSID          string            `json:"tsid"`
+	Dimensions    map[string]string `json:"dimensions"`
+}
+
+// SeriesLineage is an exported series along with its sources
+type SeriesLineage struct {
+	Name    string            `json:"name"`
+	Type    string            `json:"type"`
+	Labels  map[string]string `json:"labels"`
+	Sources []SeriesSource    `json:"sources"`
+}
+
+// lineage returns the sources of all series matching any of the selectors
+func (s *seriesStore) lineage(selectors []selector) []SeriesLineage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := []SeriesLineage{}
+	for name, family := range s.families {
+		for _, ser := range family.series {
+			if !matchesAnySelector(selectors, name, ser.labelNames, ser.labelValues) {
+				continue
+			}
+			lineage := SeriesLineage{
+				Name:    name,
+				Type:    family.metricType,
+				Labels:  make(map[string]string, len(ser.labelNames)),
+				Sources: make([]SeriesSource, 0, len(ser.sources)),
+			}
+			for i, labelName := range ser.labelNames {
+				lineage.Labels[labelName] = ser.labelValues[i]
+			}
+			for _, source := range ser.sources {
+				lineage.Sources = append(lineage.Sources, SeriesSource{
+					Flow:          source.flow,
+					Stream:        source.stream,
+					Template:      source.template,
+					TemplateIndex: source.templateIndex,
+					TSID:          source.tsid.String(),
+					Dimensions:    source.dimensions,
+				})
+			}
+			sort.Slice(lineage.Sources, func(i, j int) bool {
+				return lineage.Sources[i].TSID < lineage.Sources[j].TSID
+			})
+			result = append(result, lineage)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		return seriesKey(sortedLabels(result[i].Labels)) < seriesKey(sortedLabels(result[j].Labels))
+	})
+	return result
+}
+
+func matchesAnySelector(selectors []selector, name string, labelNames []string, labelValues []string) bool {
+	for _, sel := range selectors {
+		if sel.matches(name, labelNames, labelValues) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedLabels(labels map[string]string) ([]string, []string) {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = labels[name]
+	}
+	return names, values
+}
+
+// lineageHandler renders the sources of the series matching the match[]
+// selectors as JSON
+func lineageHandler(w http.ResponseWriter, r *http.Request) {
+	selectors := r.URL.Query()["match[]"]
+	if len(selectors) == 0 {
+		http.Error(w, "At least one match[] selector is required", http.StatusBadRequest)
+		return
+	}
+	parsed := make([]selector, 0, len(selectors))
+	for _, s := range selectors {
+		sel, err := parseSelector(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		parsed = append(parsed, sel)
+	}
+	data := sfxStore.lineage(parsed)
+	w.Header().Set("Content-Type", "application/json")
+	response := struct {
+		Status string          `json:"status"`
+		Data   []SeriesLineage `json:"data"`
+	}{Status: "success", Data: data}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Failed to render lineage API response - %+s\n", err)
+	}
+}
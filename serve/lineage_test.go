@@ -0,0 +1,56 @@
+package serve
+
+import (
+	"testing"
+
+	"github.com/signalfx/signalfx-go/idtool"
+	"github.com/signalfx/signalfx-go/signalflow/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLineage(t *testing.T) {
+	cfg, fp := loadFlow(t, `---
+flows:
+- name: catchpoint-data
+  query: data('catchpoint.responsetime').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    name: catchpoint_response_time
+    labels:
+      instance: '{{ .SignalFxLabels.cp_testname }}'
+`)
+	cache := newRenderCache(cfg, fp)
+	store := newSeriesStore()
+
+	// two time series of different nodes end up in the same series
+	first := testMetadata("test-a")
+	second := testMetadata("test-a")
+	second.CustomProperties["cp_nodename"] = "node-2"
+	for tsid, meta := range map[int64]*messages.MetadataProperties{1: first, 2: second} {
+		rendered := cache.get(idtool.ID(tsid), meta)
+		assert.Nil(t, store.setGauge(rendered.templates[0].series, 1))
+	}
+	rendered := cache.get(idtool.ID(3), testMetadata("test-b"))
+	assert.Nil(t, store.setGauge(rendered.templates[0].series, 1))
+
+	sel, err := parseSelector(`catchpoint_response_time{instance="test-a"}`)
+	assert.Nil(t, err)
+	lineage := store.lineage([]selector{sel})
+	assert.Len(t, lineage, 1)
+	assert.Equal(t, "gauge", lineage[0].Type)
+	assert.Equal(t, "test-a", lineage[0].Labels["instance"])
+	assert.Len(t, lineage[0].Sources, 2)
+	source := lineage[0].Sources[0]
+	assert.Equal(t, "catchpoint-data", source.Flow)
+	assert.Equal(t, "default", source.Stream)
+	assert.Equal(t, 0, source.TemplateIndex)
+	assert.Equal(t, idtool.ID(1).String(), source.TSID)
+	assert.Equal(t, "web", source.Dimensions["cp_testtype"])
+
+	all, err := parseSelector(`catchpoint_response_time`)
+	assert.Nil(t, err)
+	assert.Len(t, store.lineage([]selector{all}), 2)
+
+	// series matching several selectors are returned once
+	assert.Len(t, store.lineage([]selector{sel, all}), 2)
+}
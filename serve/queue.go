@@ -0,0 +1,103 @@
+package serve
+
+import (
+	"sync"
+	"time"
+
+	"signalfx-prometheus-exporter/config"
+
+	"github.com/signalfx/signalfx-go/signalflow/messages"
+)
+
+// queuedDatapoint is a datapoint received from SignalFlow that waits to be
+// applied to the store
+type queuedDatapoint struct {
+	payload   messages.DataPayload
+	timestamp time.Time
+	received  time.Time
+}
+
+// datapointQueue is a bounded FIFO queue between the goroutine receiving
+// datapoints of a flow and the goroutine applying them to the store. When the
+// queue is full, push blocks or drops a datapoint according to the policy.
+type datapointQueue struct {
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	policy   string
+	items    []queuedDatapoint
+	head     int
+	size     int
+	closed   bool
+}
+
+func newDatapointQueue(q config.Queue) *datapointQueue {
+	dq := &datapointQueue{
+		policy: q.DropPolicy,
+		items:  make([]queuedDatapoint, q.Size),
+	}
+	dq.notEmpty = sync.NewCond(&dq.mu)
+	dq.notFull = sync.NewCond(&dq.mu)
+	return dq
+}
+
+// push adds a datapoint to the queue and reports if a datapoint was dropped
+// to make room for it, or the datapoint itself was dropped
+func (dq *datapointQueue) push(dp queuedDatapoint) bool {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	dropped := false
+	for dq.size == len(dq.items) && !dq.closed {
+		switch dq.policy {
+		case config.DropPolicyNewest:
+			return true
+		case config.DropPolicyOldest:
+			dq.head = (dq.head + 1) % len(dq.items)
+			dq.size--
+			dropped = true
+		default:
+			dq.notFull.Wait()
+		}
+	}
+	if dq.closed {
+		return true
+	}
+	dq.items[(dq.head+dq.size)%len(dq.items)] = dp
+	dq.size++
+	dq.notEmpty.Signal()
+	return dropped
+}
+
+// pop removes the oldest datapoint from the queue and blocks while the queue
+// is empty. It returns false once the queue is closed and drained.
+func (dq *datapointQueue) pop() (queuedDatapoint, bool) {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	for dq.size == 0 {
+		if dq.closed {
+			return queuedDatapoint{}, false
+		}
+		dq.notEmpty.Wait()
+	}
+	dp := dq.items[dq.head]
+	dq.items[dq.head] = queuedDatapoint{}
+	dq.head = (dq.head + 1) % len(dq.items)
+	dq.size--
+	dq.notFull.Signal()
+	return dp, true
+}
+
+func (dq *datapointQueue) len() int {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	return dq.size
+}
+
+// close stops accepting datapoints, queued datapoints can still be popped
+func (dq *datapointQueue) close() {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	dq.closed = true
+	dq.notEmpty.Broadcast()
+	dq.notFull.Broadcast()
+}
@@ -0,0 +1,66 @@
+package serve
+
+import (
+	"testing"
+	"time"
+
+	"signalfx-prometheus-exporter/config"
+
+	"github.com/signalfx/signalfx-go/idtool"
+	"github.com/signalfx/signalfx-go/signalflow/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+func queuedTSID(tsid int64) queuedDatapoint {
+	return queuedDatapoint{payload: messages.DataPayload{TSID: idtool.ID(tsid)}}
+}
+
+func popTSIDs(dq *datapointQueue) []idtool.ID {
+	dq.close()
+	tsids := []idtool.ID{}
+	for {
+		dp, ok := dq.pop()
+		if !ok {
+			return tsids
+		}
+		tsids = append(tsids, dp.payload.TSID)
+	}
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	dq := newDatapointQueue(config.Queue{Size: 2, DropPolicy: config.DropPolicyOldest})
+	assert.False(t, dq.push(queuedTSID(1)))
+	assert.False(t, dq.push(queuedTSID(2)))
+	assert.True(t, dq.push(queuedTSID(3)))
+	assert.Equal(t, 2, dq.len())
+	assert.Equal(t, []idtool.ID{2, 3}, popTSIDs(dq))
+}
+
+func TestQueueDropNewest(t *testing.T) {
+	dq := newDatapointQueue(config.Queue{Size: 2, DropPolicy: config.DropPolicyNewest})
+	assert.False(t, dq.push(queuedTSID(1)))
+	assert.False(t, dq.push(queuedTSID(2)))
+	assert.True(t, dq.push(queuedTSID(3)))
+	assert.Equal(t, []idtool.ID{1, 2}, popTSIDs(dq))
+}
+
+func TestQueueBlock(t *testing.T) {
+	dq := newDatapointQueue(config.Queue{Size: 1, DropPolicy: config.DropPolicyBlock})
+	assert.False(t, dq.push(queuedTSID(1)))
+
+	pushed := make(chan bool)
+	go func() {
+		pushed <- dq.push(queuedTSID(2))
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push to a full queue must block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	dp, ok := dq.pop()
+	assert.True(t, ok)
+	assert.Equal(t, idtool.ID(1), dp.payload.TSID)
+	assert.False(t, <-pushed)
+	assert.Equal(t, []idtool.ID{2}, popTSIDs(dq))
+}
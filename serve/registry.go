@@ -1,6 +1,7 @@
 package serve
 
 import (
+	"errors"
 	"fmt"
 	"signalfx-prometheus-exporter/config"
 
@@ -8,6 +9,10 @@ import (
 	dto "github.com/prometheus/client_model/go"
 )
 
+// errGroupNotReady fails a group scrape regardless of the error handling of
+// the scrape endpoint
+var errGroupNotReady = errors.New("Not enough metrics in group")
+
 type FilteringRegistry struct {
 	Registry    prometheus.Gatherer
 	Grouping    config.Grouping
@@ -15,18 +20,83 @@ type FilteringRegistry struct {
 }
 
 func (fr *FilteringRegistry) Gather() ([]*dto.MetricFamily, error) {
-	var metricCount uint = 0
-	mfs, err := fr.Registry.Gather()
-	if err != nil {
-		return nil, err
+	// partial results of a failed gather are filtered as well, the scrape
+	// endpoint decides if they are served
+	mfs, gatherErr := fr.Registry.Gather()
+
+	// an empty filter value would select every series without the label
+	selectors := []selector{}
+	if fr.FilterValue != "" {
+		selectors = append(selectors, selector{labelMatcher{name: fr.Grouping.Label, op: "=", value: fr.FilterValue}})
+	}
+	filteredMfs, metricCount := selectSeries(mfs, selectors)
+
+	if metricCount >= fr.Grouping.GroupReadyCondition.MinMetrics {
+		return filteredMfs, gatherErr
+	} else {
+		return nil, fmt.Errorf("%w. minMetrics = %d", errGroupNotReady, fr.Grouping.GroupReadyCondition.MinMetrics)
 	}
+}
 
-	filteredMfs := []*dto.MetricFamily{}
+// UnitRegistry sets the OpenMetrics unit of the gathered metric families from
+// the metric templates that created them
+type UnitRegistry struct {
+	Registry prometheus.Gatherer
+	Store    *seriesStore
+}
+
+func (ur *UnitRegistry) Gather() ([]*dto.MetricFamily, error) {
+	mfs, gatherErr := ur.Registry.Gather()
+	units := ur.Store.units()
+	for _, mf := range mfs {
+		if unit, ok := units[mf.GetName()]; ok {
+			mf.Unit = &unit
+		}
+	}
+	return mfs, gatherErr
+}
+
+// SelectingRegistry gathers the series matched by any of its selectors, like
+// the match[] parameters of the Prometheus federation endpoint
+type SelectingRegistry struct {
+	Registry  prometheus.Gatherer
+	Selectors []selector
+}
+
+// newSelectingRegistry parses the match[] parameters of a request. Selectors
+// that match empty label values are rejected, they would select every series.
+func newSelectingRegistry(registry prometheus.Gatherer, matches []string) (*SelectingRegistry, error) {
+	sr := &SelectingRegistry{Registry: registry}
+	for _, match := range matches {
+		sel, err := parseSelector(match)
+		if err != nil {
+			return nil, err
+		}
+		if sel.matchesEmpty() {
+			return nil, fmt.Errorf("Selector %s must contain at least one matcher that doesn't match empty values", match)
+		}
+		sr.Selectors = append(sr.Selectors, sel)
+	}
+	return sr, nil
+}
+
+func (sr *SelectingRegistry) Gather() ([]*dto.MetricFamily, error) {
+	mfs, gatherErr := sr.Registry.Gather()
+	selectedMfs, _ := selectSeries(mfs, sr.Selectors)
+	return selectedMfs, gatherErr
+}
+
+// selectSeries returns the series of the metric families that match any of
+// the selectors and the number of selected series. Metric names are matched
+// against the family name, e.g. histograms without the _bucket suffix.
+func selectSeries(mfs []*dto.MetricFamily, selectors []selector) ([]*dto.MetricFamily, uint) {
+	var metricCount uint = 0
+	selectedMfs := []*dto.MetricFamily{}
 	for _, mf := range mfs {
 		metrics := []*dto.Metric{}
 		for _, m := range mf.GetMetric() {
-			for _, l := range m.GetLabel() {
-				if *l.Name == fr.Grouping.Label && *l.Value == fr.FilterValue {
+			for _, sel := range selectors {
+				if sel.matchesLabelPairs(mf.GetName(), m.GetLabel()) {
 					metrics = append(metrics, m)
 					metricCount++
 					break
@@ -34,18 +104,14 @@ func (fr *FilteringRegistry) Gather() ([]*dto.MetricFamily, error) {
 			}
 		}
 		if len(metrics) > 0 {
-			filteredMfs = append(filteredMfs, &dto.MetricFamily{
+			selectedMfs = append(selectedMfs, &dto.MetricFamily{
 				Name:   mf.Name,
 				Help:   mf.Help,
 				Type:   mf.Type,
+				Unit:   mf.Unit,
 				Metric: metrics,
 			})
 		}
 	}
-
-	if metricCount >= fr.Grouping.GroupReadyCondition.MinMetrics {
-		return filteredMfs, nil
-	} else {
-		return nil, fmt.Errorf("Not enough metrics in group. minMetrics = %d", fr.Grouping.GroupReadyCondition.MinMetrics)
-	}
+	return selectedMfs, metricCount
 }
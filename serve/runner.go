@@ -0,0 +1,161 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"signalfx-prometheus-exporter/config"
+)
+
+var (
+	errFlowPaused    = errors.New("flow is paused")
+	errFlowNotPaused = errors.New("flow is not paused")
+)
+
+// flowRunner runs the SignalFlow computation of a flow and stops and starts
+// it again on request of the admin API
+type flowRunner struct {
+	fp     config.FlowProgram
+	status *flowStatus
+	stream func(ctx context.Context) error
+
+	mu     sync.Mutex
+	paused bool
+	// cancel stops the running computation, done is closed once it stopped.
+	// Both are nil while the computation is not running.
+	cancel  context.CancelFunc
+	done    chan struct{}
+	resumed chan struct{}
+}
+
+// flowRunners holds the runners of all flows by name
+var flowRunners = struct {
+	sync.Mutex
+	runners map[string]*flowRunner
+}{runners: make(map[string]*flowRunner)}
+
+func newFlowRunner(cfg *config.Config, fp config.FlowProgram) *flowRunner {
+	status := statusOf(fp)
+	runner := &flowRunner{
+		fp:     fp,
+		status: status,
+		stream: func(ctx context.Context) error {
+			return streamData(ctx, cfg, fp, status)
+		},
+		resumed: make(chan struct{}, 1),
+	}
+	flowRunners.Lock()
+	defer flowRunners.Unlock()
+	flowRunners.runners[fp.Name] = runner
+	return runner
+}
+
+// runnerOf returns the runner of a flow
+func runnerOf(name string) (*flowRunner, bool) {
+	flowRunners.Lock()
+	defer flowRunners.Unlock()
+	runner, ok := flowRunners.runners[name]
+	return runner, ok
+}
+
+// run streams the data of the flow until ctx is done or the computation
+// fails. A computation stopped by pause or restart is started again once the
+// flow is not paused.
+func (r *flowRunner) run(ctx context.Context) error {
+	for {
+		runCtx := r.next(ctx)
+		if runCtx == nil {
+			return nil
+		}
+		r.status.setState(flowStateConnecting)
+		err := r.stream(runCtx)
+		stopped := runCtx.Err() != nil
+
+		r.mu.Lock()
+		r.cancel()
+		close(r.done)
+		r.cancel, r.done = nil, nil
+		r.mu.Unlock()
+
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !stopped {
+			return err
+		}
+	}
+}
+
+// next waits until the flow is not paused and returns the context of its
+// next computation, or nil when ctx is done
+func (r *flowRunner) next(ctx context.Context) context.Context {
+	for {
+		r.mu.Lock()
+		if !r.paused {
+			runCtx, cancel := context.WithCancel(ctx)
+			r.cancel, r.done = cancel, make(chan struct{})
+			r.mu.Unlock()
+			return runCtx
+		}
+		r.mu.Unlock()
+		select {
+		case <-r.resumed:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// stop stops the running computation and waits until it stopped. Must be
+// called with the lock held, the lock is released while waiting.
+func (r *flowRunner) stop() {
+	if r.cancel == nil {
+		return
+	}
+	r.cancel()
+	done := r.done
+	r.mu.Unlock()
+	<-done
+	r.mu.Lock()
+}
+
+// pause stops the computation of the flow until it is resumed
+func (r *flowRunner) pause() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.paused {
+		return errFlowPaused
+	}
+	r.paused = true
+	r.stop()
+	r.status.setState(flowStatePaused)
+	return nil
+}
+
+// resume starts the computation of a paused flow again
+func (r *flowRunner) resume() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.paused {
+		return errFlowNotPaused
+	}
+	r.paused = false
+	select {
+	case r.resumed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// restart stops the computation of the flow and starts a new one
+func (r *flowRunner) restart() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.paused {
+		return errFlowPaused
+	}
+	r.stop()
+	r.status.restarted()
+	return nil
+}
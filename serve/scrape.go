@@ -0,0 +1,138 @@
+package serve
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"signalfx-prometheus-exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// scrapeTimeout bounds the time spent gathering and encoding a scrape
+const scrapeTimeout = 5 * time.Second
+
+// scrapeEndpoint serves gathered metrics with the scrape options of one
+// endpoint. The concurrency limit is shared by all requests to the endpoint.
+type scrapeEndpoint struct {
+	opts     promhttp.HandlerOpts
+	inFlight chan struct{}
+}
+
+func newScrapeEndpoint(so config.ScrapeOptions) *scrapeEndpoint {
+	errorHandling := promhttp.HTTPErrorOnError
+	if so.ErrorHandling == config.ErrorHandlingContinue {
+		errorHandling = promhttp.ContinueOnError
+	}
+	se := &scrapeEndpoint{
+		opts: promhttp.HandlerOpts{
+			ErrorLog:           log.Default(),
+			ErrorHandling:      errorHandling,
+			DisableCompression: so.DisableCompression,
+			EnableOpenMetrics:  so.OpenMetrics,
+		},
+	}
+	if so.MaxConcurrentScrapes > 0 {
+		se.inFlight = make(chan struct{}, so.MaxConcurrentScrapes)
+	}
+	return se
+}
+
+func (se *scrapeEndpoint) serveGatherer(g prometheus.Gatherer, w http.ResponseWriter, r *http.Request) {
+	if se.inFlight != nil {
+		select {
+		case se.inFlight <- struct{}{}:
+			defer func() { <-se.inFlight }()
+		default:
+			http.Error(w, fmt.Sprintf(
+				"Limit of concurrent scrapes reached (%d), try again later.", cap(se.inFlight),
+			), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), scrapeTimeout)
+	defer cancel()
+
+	// gather once up front, groups that are not ready fail the scrape even
+	// when the endpoint continues on errors
+	mfs, err := g.Gather()
+	if errors.Is(err, errGroupNotReady) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if se.opts.EnableOpenMetrics {
+		if format := expfmt.NegotiateIncludingOpenMetrics(r.Header); format.FormatType() == expfmt.TypeOpenMetrics {
+			se.serveOpenMetrics(format, mfs, err, w, r)
+			return
+		}
+	}
+	gathered := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return mfs, err
+	})
+	promhttp.HandlerFor(gathered, se.opts).ServeHTTP(w, r.WithContext(ctx))
+}
+
+// serveOpenMetrics encodes gathered metrics as OpenMetrics including the
+// # UNIT lines of the metric families, promhttp doesn't offer the encoder
+// option. Errors are handled like promhttp does.
+func (se *scrapeEndpoint) serveOpenMetrics(format expfmt.Format, mfs []*dto.MetricFamily, err error, w http.ResponseWriter, r *http.Request) {
+	if err != nil {
+		log.Printf("Error gathering metrics - %+s\n", err)
+		if se.opts.ErrorHandling != promhttp.ContinueOnError || len(mfs) == 0 {
+			http.Error(w, "An error has occurred while serving metrics:\n\n"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", string(format))
+	var out io.Writer = w
+	if !se.opts.DisableCompression && acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+	enc := expfmt.NewEncoder(out, format, expfmt.WithUnit())
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			log.Printf("Error encoding metric family %s - %+s\n", mf.GetName(), err)
+			if se.opts.ErrorHandling == promhttp.HTTPErrorOnError {
+				return
+			}
+		}
+	}
+	if closer, ok := enc.(expfmt.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Error closing OpenMetrics response - %+s\n", err)
+		}
+	}
+}
+
+// acceptsGzip checks the Accept-Encoding header of a request for gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(encoding, ";")
+		if strings.TrimSpace(params[0]) != "gzip" {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package serve
+
+import (
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"signalfx-prometheus-exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func partialGatherer() prometheus.Gatherer {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "some_gauge"}, []string{"group"})
+	gauge.WithLabelValues("a").Set(1)
+	registry.MustRegister(gauge)
+	return prometheus.Gatherers{
+		registry,
+		prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return nil, errors.New("collector failed")
+		}),
+	}
+}
+
+func scrape(endpoint *scrapeEndpoint, g prometheus.Gatherer, accept string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	endpoint.serveGatherer(g, w, r)
+	return w
+}
+
+func TestScrapeOpenMetrics(t *testing.T) {
+	accept := "application/openmetrics-text; version=0.0.1"
+
+	w := scrape(newScrapeEndpoint(config.ScrapeOptions{}), sfxRegistry, accept)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain"))
+
+	w = scrape(newScrapeEndpoint(config.ScrapeOptions{OpenMetrics: true}), sfxRegistry, accept)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "application/openmetrics-text"))
+	assert.True(t, strings.HasSuffix(w.Body.String(), "# EOF\n"))
+
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	r.Header.Set("Accept", accept)
+	r.Header.Set("Accept-Encoding", "deflate, gzip;q=0.5")
+	w = httptest.NewRecorder()
+	newScrapeEndpoint(config.ScrapeOptions{OpenMetrics: true}).serveGatherer(partialGatherer(), w, r)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	w = httptest.NewRecorder()
+	newScrapeEndpoint(config.ScrapeOptions{OpenMetrics: true, ErrorHandling: config.ErrorHandlingContinue}).serveGatherer(partialGatherer(), w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	gz, err := gzip.NewReader(w.Body)
+	assert.Nil(t, err)
+	body, err := ioutil.ReadAll(gz)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), "some_gauge{group=\"a\"} 1.0\n# EOF\n")
+
+	r.Header.Set("Accept-Encoding", "gzip;q=0")
+	assert.False(t, acceptsGzip(r))
+}
+
+func TestScrapeErrorHandling(t *testing.T) {
+	w := scrape(newScrapeEndpoint(config.ScrapeOptions{ErrorHandling: config.ErrorHandlingFail}), partialGatherer(), "")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	w = scrape(newScrapeEndpoint(config.ScrapeOptions{ErrorHandling: config.ErrorHandlingContinue}), partialGatherer(), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `some_gauge{group="a"} 1`)
+}
+
+func TestScrapeGroupNotReady(t *testing.T) {
+	group := &FilteringRegistry{
+		Registry:    partialGatherer(),
+		Grouping:    config.Grouping{Label: "group", GroupReadyCondition: config.GroupReadyCondition{MinMetrics: 1}},
+		FilterValue: "a",
+	}
+	endpoint := newScrapeEndpoint(config.ScrapeOptions{ErrorHandling: config.ErrorHandlingContinue})
+	w := scrape(endpoint, group, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `some_gauge{group="a"} 1`)
+
+	group.FilterValue = "b"
+	w = scrape(endpoint, group, "")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestScrapeConcurrencyLimit(t *testing.T) {
+	endpoint := newScrapeEndpoint(config.ScrapeOptions{MaxConcurrentScrapes: 1})
+	endpoint.inFlight <- struct{}{}
+	w := scrape(endpoint, sfxRegistry, "")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	<-endpoint.inFlight
+	w = scrape(endpoint, sfxRegistry, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
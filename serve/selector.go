@@ -0,0 +1,194 @@
+package serve
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"signalfx-prometheus-exporter/config"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// labelMatcher matches the value of a label of a series, the metric name is
+// matched as __name__ label
+type labelMatcher struct {
+	name  string
+	op    string
+	value string
+	regex *regexp.Regexp
+}
+
+func (lm *labelMatcher) matches(value string) bool {
+	switch lm.op {
+	case "=":
+		return value == lm.value
+	case "!=":
+		return value != lm.value
+	case "=~":
+		return lm.regex.MatchString(value)
+	default:
+		return !lm.regex.MatchString(value)
+	}
+}
+
+// selector selects series like a Prometheus series selector, e.g.
+// metric_name{label="value",other=~"regex"}
+type selector []labelMatcher
+
+var (
+	selectorMetricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*`)
+	selectorLabelName  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*`)
+	selectorOperator   = regexp.MustCompile(`^(=~|!~|!=|=)`)
+	selectorString     = regexp.MustCompile(`^("(\\.|[^"\\])*"|'(\\.|[^'\\])*')`)
+)
+
+func parseSelector(s string) (selector, error) {
+	sel := selector{}
+	rest := strings.TrimSpace(s)
+	if name := selectorMetricName.FindString(rest); name != "" {
+		sel = append(sel, labelMatcher{name: config.MetricNameLabel, op: "=", value: name})
+		rest = strings.TrimSpace(rest[len(name):])
+	}
+	if strings.HasPrefix(rest, "{") {
+		rest = strings.TrimSpace(rest[1:])
+		for !strings.HasPrefix(rest, "}") {
+			matcher, remaining, err := parseLabelMatcher(rest)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid selector %s - %+s", s, err)
+			}
+			sel = append(sel, matcher)
+			rest = strings.TrimSpace(remaining)
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimSpace(rest[1:])
+			} else if !strings.HasPrefix(rest, "}") {
+				return nil, fmt.Errorf("Invalid selector %s - expected , or }", s)
+			}
+		}
+		rest = strings.TrimSpace(rest[1:])
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("Invalid selector %s - unexpected %s", s, rest)
+	}
+	if len(sel) == 0 {
+		return nil, fmt.Errorf("Selector must not be empty")
+	}
+	return sel, nil
+}
+
+// doubleQuote turns a single quoted string into a double quoted one that
+// strconv.Unquote accepts, \' is unescaped and " escaped
+func doubleQuote(quoted string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	inner := quoted[1 : len(quoted)-1]
+	for i := 0; i < len(inner); i++ {
+		switch {
+		case inner[i] == '\\' && i+1 < len(inner):
+			i++
+			if inner[i] != '\'' {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(inner[i])
+		case inner[i] == '"':
+			b.WriteString(`\"`)
+		default:
+			b.WriteByte(inner[i])
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func parseLabelMatcher(s string) (labelMatcher, string, error) {
+	name := selectorLabelName.FindString(s)
+	if name == "" {
+		return labelMatcher{}, "", fmt.Errorf("expected label name at %s", s)
+	}
+	s = strings.TrimSpace(s[len(name):])
+	op := selectorOperator.FindString(s)
+	if op == "" {
+		return labelMatcher{}, "", fmt.Errorf("expected match operator after %s", name)
+	}
+	s = strings.TrimSpace(s[len(op):])
+	quoted := selectorString.FindString(s)
+	if quoted == "" {
+		return labelMatcher{}, "", fmt.Errorf("expected quoted value for %s", name)
+	}
+	if quoted[0] == '\'' {
+		quoted = doubleQuote(quoted)
+	}
+	value, err := strconv.Unquote(quoted)
+	if err != nil {
+		return labelMatcher{}, "", fmt.Errorf("invalid value for %s", name)
+	}
+	matcher := labelMatcher{name: name, op: op, value: value}
+	if op == "=~" || op == "!~" {
+		if matcher.regex, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+			return labelMatcher{}, "", err
+		}
+	}
+	return matcher, s[len(selectorString.FindString(s)):], nil
+}
+
+// matches checks a series against all matchers of the selector. Labels the
+// series doesn't have match as empty string.
+func (sel selector) matches(name string, labelNames []string, labelValues []string) bool {
+	return sel.matchesLabels(name, func(label string) string {
+		for j, labelName := range labelNames {
+			if labelName == label {
+				return labelValues[j]
+			}
+		}
+		return ""
+	})
+}
+
+// matchesLabelPairs checks a gathered series against all matchers of the
+// selector
+func (sel selector) matchesLabelPairs(name string, labels []*dto.LabelPair) bool {
+	return sel.matchesLabels(name, func(label string) string {
+		for _, l := range labels {
+			if l.GetName() == label {
+				return l.GetValue()
+			}
+		}
+		return ""
+	})
+}
+
+func (sel selector) matchesLabels(name string, labelValue func(label string) string) bool {
+	for i := range sel {
+		lm := &sel[i]
+		value := name
+		if lm.name != config.MetricNameLabel {
+			value = labelValue(lm.name)
+		}
+		if !lm.matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesEmpty reports whether all matchers match an empty value, such a
+// selector selects every series that lacks its labels
+func (sel selector) matchesEmpty() bool {
+	for i := range sel {
+		if !sel[i].matches("") {
+			return false
+		}
+	}
+	return true
+}
+
+// metricName returns the metric name the selector requires, if any
+func (sel selector) metricName() (string, bool) {
+	for _, lm := range sel {
+		if lm.name == config.MetricNameLabel && lm.op == "=" {
+			return lm.value, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,125 @@
+package serve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"signalfx-prometheus-exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSelector(t *testing.T) {
+	sel, err := parseSelector(`some_metric{instance="a", job=~"api|web",env!="dev", zone!~'eu-.*'}`)
+	assert.Nil(t, err)
+	assert.Len(t, sel, 5)
+	name, ok := sel.metricName()
+	assert.True(t, ok)
+	assert.Equal(t, "some_metric", name)
+
+	labelNames := []string{"env", "instance", "job", "zone"}
+	assert.True(t, sel.matches("some_metric", labelNames, []string{"prod", "a", "web", "us-1"}))
+	assert.False(t, sel.matches("other_metric", labelNames, []string{"prod", "a", "web", "us-1"}))
+	assert.False(t, sel.matches("some_metric", labelNames, []string{"dev", "a", "web", "us-1"}))
+	assert.False(t, sel.matches("some_metric", labelNames, []string{"prod", "a", "webserver", "us-1"}))
+	assert.False(t, sel.matches("some_metric", labelNames, []string{"prod", "a", "web", "eu-1"}))
+
+	sel, err = parseSelector(`{__name__=~"some_.*", missing=""}`)
+	assert.Nil(t, err)
+	_, ok = sel.metricName()
+	assert.False(t, ok)
+	assert.True(t, sel.matches("some_metric", nil, nil))
+
+	for quoted, expected := range map[string]string{
+		`'x\'y'`:   `x'y`,
+		`'x"y'`:    `x"y`,
+		`'x\\'`:    `x\`,
+		`'x\ty'`:   "x\ty",
+		`"x\"y"`:   `x"y`,
+		`'x\\\'y'`: `x\'y`,
+	} {
+		sel, err = parseSelector(`{a=` + quoted + `}`)
+		if assert.Nil(t, err, quoted) {
+			assert.Equal(t, expected, sel[0].value, quoted)
+		}
+	}
+
+	for _, invalid := range []string{``, `{}`, `some_metric{`, `some_metric{instance}`, `some_metric{instance=a}`, `some_metric{job=~"("}`, `some metric`} {
+		_, err := parseSelector(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func selectorRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "some_gauge"}, []string{"instance", "env"})
+	gauge.WithLabelValues("web-1", "prod").Set(1)
+	gauge.WithLabelValues("web-2", "dev").Set(2)
+	gauge.WithLabelValues("db-1", "prod").Set(3)
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "some_counter_total"}, []string{"instance"})
+	counter.WithLabelValues("web-1").Add(1)
+	registry.MustRegister(gauge, counter)
+	return registry
+}
+
+func TestSelectingRegistry(t *testing.T) {
+	registry := selectorRegistry()
+	count := func(matches ...string) int {
+		sr, err := newSelectingRegistry(registry, matches)
+		assert.Nil(t, err)
+		count, err := testutil.GatherAndCount(sr)
+		assert.Nil(t, err)
+		return count
+	}
+
+	assert.Equal(t, 3, count(`some_gauge`))
+	assert.Equal(t, 2, count(`{instance="web-1"}`))
+	assert.Equal(t, 2, count(`some_gauge{env="prod"}`))
+	assert.Equal(t, 1, count(`some_gauge{env!="prod"}`))
+	assert.Equal(t, 3, count(`{instance=~"web-.*"}`))
+	assert.Equal(t, 1, count(`some_gauge{instance!~"web-.*"}`))
+	assert.Equal(t, 4, count(`{__name__=~"some_.*"}`))
+	// series matched by several selectors are gathered once
+	assert.Equal(t, 3, count(`some_gauge{env="prod"}`, `{instance="web-1"}`))
+	assert.Equal(t, 0, count(`other_gauge`))
+
+	for _, invalid := range []string{`{instance=~".*"}`, `{env=""}`, `some_gauge{`} {
+		_, err := newSelectingRegistry(registry, []string{invalid})
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestMetricsHandlerMatch(t *testing.T) {
+	for _, instance := range []string{"web-1", "db-1"} {
+		meta := seriesMetadata{
+			name:        "some_gauge",
+			labelNames:  []string{"instance"},
+			labelValues: []string{instance},
+			owner:       seriesOwner{flow: "flow-a", template: "flow-a/0"},
+		}
+		assert.Nil(t, sfxStore.setGauge(meta, 1))
+	}
+
+	endpoint := newScrapeEndpoint(config.ScrapeOptions{})
+	get := func(matches ...string) *httptest.ResponseRecorder {
+		query := url.Values{"match[]": matches}
+		w := httptest.NewRecorder()
+		metricsHandler(endpoint, w, httptest.NewRequest(http.MethodGet, "/metrics?"+query.Encode(), nil))
+		return w
+	}
+
+	w := get(`some_gauge{instance="web-1"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `some_gauge{instance="web-1"} 1`)
+	assert.NotContains(t, w.Body.String(), `db-1`)
+
+	w = get()
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `db-1`)
+
+	assert.Equal(t, http.StatusBadRequest, get(`some_gauge{`).Code)
+}
@@ -5,15 +5,19 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"signalfx-prometheus-exporter/config"
+	"signalfx-prometheus-exporter/web"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/signalfx/signalfx-go/idtool"
 	"github.com/signalfx/signalfx-go/signalflow"
 	"github.com/signalfx/signalfx-go/signalflow/messages"
 
@@ -23,17 +27,46 @@ import (
 var (
 	// sfx metrics state
 	sfxRegistry               = prometheus.NewRegistry()
-	sfxCounters               = make(map[string]*prometheus.CounterVec)
-	sfxGauges                 = make(map[string]*prometheus.GaugeVec)
+	sfxStore                  = newSeriesStore()
+	sfxGatherer               = &UnitRegistry{Registry: sfxRegistry, Store: sfxStore}
 	lastMetricInFlowTimestamp = make(map[string]time.Time)
 
 	// self observability
-	flowMetricsReceived *prometheus.CounterVec
-	flowMetricsFailed   *prometheus.CounterVec
-	flowLastReceived    *prometheus.GaugeVec
+	flowMetricsReceived   *prometheus.CounterVec
+	flowMetricsFailed     *prometheus.CounterVec
+	flowLastReceived      *prometheus.GaugeVec
+	flowNamingViolations  *prometheus.CounterVec
+	flowMetricsDropped    *prometheus.CounterVec
+	flowMetricsUnmatched  *prometheus.CounterVec
+	flowQueueDepth        *prometheus.GaugeVec
+	flowQueueDropped      *prometheus.CounterVec
+	flowProcessingLatency *prometheus.HistogramVec
+	flowSeriesLimitHit    *prometheus.CounterVec
+	flowAdminActions      *prometheus.CounterVec
+
+	// errSeriesDropped signals that a relabel config dropped a series
+	errSeriesDropped = errors.New("series dropped by relabeling")
 )
 
-func setupObservability(observabilityPort int) {
+func init() {
+	sfxRegistry.MustRegister(sfxStore)
+}
+
+// Listener declares the address a server binds to and the web config that
+// secures it
+type Listener struct {
+	Address       string
+	Port          int
+	WebConfigFile string
+	// AdminAPI serves the admin API, only supported by the observability server
+	AdminAPI bool
+}
+
+func (l Listener) addr() string {
+	return net.JoinHostPort(l.Address, strconv.Itoa(l.Port))
+}
+
+func setupObservability(listener Listener) {
 	// configure and start observability server
 	flowMetricsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "sfxpe_flow_metrics_received_total",
@@ -47,51 +80,128 @@ func setupObservability(observabilityPort int) {
 		Name: "sfxpe_flow_last_received_seconds",
 		Help: "Timestamp where the last metric was received",
 	}, []string{"flow", "stream"})
+	flowNamingViolations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfxpe_flow_naming_violations_total",
+		Help: "Number of rendered metrics that violated naming rules",
+	}, []string{"flow", "stream", "violation"})
+	flowMetricsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfxpe_flow_metrics_dropped_total",
+		Help: "Number of metrics dropped by relabeling or value filters",
+	}, []string{"flow", "stream"})
+	flowMetricsUnmatched = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfxpe_flow_metrics_unmatched_total",
+		Help: "Number of metrics not matched by any metric template",
+	}, []string{"flow", "stream"})
+	flowQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sfxpe_flow_queue_depth",
+		Help: "Number of received metrics waiting to be processed",
+	}, []string{"flow"})
+	flowQueueDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfxpe_flow_queue_dropped_total",
+		Help: "Number of received metrics dropped because the queue was full",
+	}, []string{"flow"})
+	flowProcessingLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sfxpe_flow_processing_latency_seconds",
+		Help:    "Time from receiving a metric until it was processed",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"flow"})
+	flowSeriesLimitHit = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfxpe_series_limit_hit_total",
+		Help: "Number of new series rejected because a series limit was reached",
+	}, []string{"flow", "limit"})
+	flowAdminActions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfxpe_flow_admin_actions_total",
+		Help: "Number of admin API actions performed on a flow",
+	}, []string{"flow", "action"})
 	prometheus.MustRegister(flowMetricsReceived)
 	prometheus.MustRegister(flowMetricsFailed)
 	prometheus.MustRegister(flowLastReceived)
+	prometheus.MustRegister(flowNamingViolations)
+	prometheus.MustRegister(flowMetricsDropped)
+	prometheus.MustRegister(flowMetricsUnmatched)
+	prometheus.MustRegister(flowQueueDepth)
+	prometheus.MustRegister(flowQueueDropped)
+	prometheus.MustRegister(flowProcessingLatency)
+	prometheus.MustRegister(flowSeriesLimitHit)
+	prometheus.MustRegister(flowAdminActions)
+	prometheus.MustRegister(newUsageCollector(sfxStore))
 	obsMux := mux.NewRouter()
 	obsMux.Handle("/metrics", promhttp.Handler())
-	obsServer := &http.Server{Addr: fmt.Sprintf(":%v", observabilityPort), Handler: obsMux}
+	obsMux.HandleFunc("/status", statusHandler)
+	obsMux.HandleFunc("/api/v1/flows", flowsAPIHandler)
+	obsMux.HandleFunc("/api/v1/lineage", lineageHandler)
+	obsMux.HandleFunc("/debug/flows/{name}/tail", tailHandler)
+	if listener.AdminAPI {
+		registerAdminAPI(obsMux)
+	}
+	obsServer := &http.Server{Addr: listener.addr(), Handler: obsMux}
 	go func() {
-		if err := obsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := web.ListenAndServe(obsServer, listener.WebConfigFile); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("observability server failure: %+s\n", err)
 		}
 	}()
-	log.Printf("Observability server listening on port %v\n", observabilityPort)
+	log.Printf("Observability server listening on %v\n", listener.addr())
 }
 
 func setupMetricStreaming(cfg *config.Config, ctx context.Context) context.Context {
 	errs, ctx := errgroup.WithContext(ctx)
 	for i := range cfg.Flows {
 		fp := cfg.Flows[i]
+		runner := newFlowRunner(cfg, fp)
 		errs.Go(func() error {
-			err := streamData(cfg.Sfx, fp)
+			err := runner.run(ctx)
+			if err == nil {
+				return nil
+			}
 			log.Printf("Flow %s failed because of %+s\n", fp.Name, err)
+			runner.status.failed(err)
 			return err
 		})
 	}
 	return ctx
 }
 
-func serve(cfg *config.Config, listenPort int, ctx context.Context) {
+func serve(cfg *config.Config, listener Listener, ctx context.Context) {
 	// configure and start scrape server
 	mux := mux.NewRouter()
 	mux.HandleFunc("/ready", readinessHandler)
 	mux.HandleFunc("/healthy", livenessHandler)
-	mux.HandleFunc("/metrics", metricsHandler)
+	metricsEndpoint := newScrapeEndpoint(cfg.Scrape)
+	mux.HandleFunc("/metrics", func(rw http.ResponseWriter, r *http.Request) {
+		metricsHandler(metricsEndpoint, rw, r)
+	})
 	for _, g := range cfg.Groupings {
+		g := g
+		groupEndpoint := newScrapeEndpoint(g.ScrapeOptions(cfg.Scrape))
 		mux.HandleFunc(fmt.Sprintf("/metrics/%s", g.Label), func(rw http.ResponseWriter, r *http.Request) {
-			probeHandler(g, rw, r)
+			probeHandler(groupEndpoint, g, rw, r)
 		})
 	}
-	server := &http.Server{Addr: fmt.Sprintf(":%v", listenPort), Handler: mux}
+	// flows and scrape groups share the scrape options and concurrency limit
+	// of one endpoint
+	flowsEndpoint := newScrapeEndpoint(cfg.Scrape)
+	flowGatherers := make(map[string]prometheus.Gatherer, len(cfg.Flows))
+	for _, fp := range cfg.Flows {
+		flowGatherers[fp.Name] = newFlowsGatherer(sfxStore, fp.Name)
+	}
+	mux.HandleFunc("/metrics/flow/{name}", func(rw http.ResponseWriter, r *http.Request) {
+		flowsMetricsHandler(flowsEndpoint, flowGatherers, "Flow", rw, r)
+	})
+	groupGatherers := make(map[string]prometheus.Gatherer)
+	for group, flows := range cfg.ScrapeGroups() {
+		groupGatherers[group] = newFlowsGatherer(sfxStore, flows...)
+	}
+	mux.HandleFunc("/metrics/group/{name}", func(rw http.ResponseWriter, r *http.Request) {
+		flowsMetricsHandler(flowsEndpoint, groupGatherers, "Scrape group", rw, r)
+	})
+	server := &http.Server{Addr: listener.addr(), Handler: mux}
 	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		// health checks stay reachable for probes without credentials
+		if err := web.ListenAndServe(server, listener.WebConfigFile, "/ready", "/healthy"); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("metrics server failure: %+s\n", err)
 		}
 	}()
-	log.Printf("Scrape server listening on port %v\n", listenPort)
+	log.Printf("Scrape server listening on %v\n", listener.addr())
 
 	<-ctx.Done()
 
@@ -107,15 +217,22 @@ func serve(cfg *config.Config, listenPort int, ctx context.Context) {
 	}
 }
 
-func CollectoAndServe(configFile string, listenPort int, observabilityPort int, ctx context.Context) {
+func CollectoAndServe(configFile string, scrapeListener Listener, observabilityListener Listener, ctx context.Context) {
 	cfg, err := config.LoadConfig(configFile)
 	if err != nil {
 		log.Printf("failed to load config: %+s\n", err)
 		return
 	}
-	setupObservability(observabilityPort)
+	if observabilityListener.AdminAPI {
+		if err := checkAdminAPI(observabilityListener.WebConfigFile); err != nil {
+			log.Printf("failed to enable admin API: %+s\n", err)
+			return
+		}
+	}
+	sfxStore.setMaxSeries(cfg.MaxSeries)
+	setupObservability(observabilityListener)
 	ctx = setupMetricStreaming(cfg, ctx)
-	serve(cfg, listenPort, ctx)
+	serve(cfg, scrapeListener, ctx)
 }
 
 func readinessHandler(w http.ResponseWriter, r *http.Request) {
@@ -126,42 +243,54 @@ func livenessHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func probeHandler(grouping config.Grouping, w http.ResponseWriter, r *http.Request) {
+func probeHandler(endpoint *scrapeEndpoint, grouping config.Grouping, w http.ResponseWriter, r *http.Request) {
 	// blackbox exporter compatible scrape handler
-	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(5*float64(time.Second)))
-	defer cancel()
-	r = r.WithContext(ctx)
-
 	targetValue, ok := r.URL.Query()["target"]
-	if ok && len(targetValue) > 0 {
-		metricGatherer := &FilteringRegistry{
-			Registry:    sfxRegistry,
-			Grouping:    grouping,
-			FilterValue: targetValue[0],
-		}
-		h := promhttp.HandlerFor(metricGatherer, promhttp.HandlerOpts{})
-		h.ServeHTTP(w, r)
-		return
-	} else {
+	if !ok || len(targetValue) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	metricGatherer := &FilteringRegistry{
+		Registry:    sfxGatherer,
+		Grouping:    grouping,
+		FilterValue: targetValue[0],
 	}
+	endpoint.serveGatherer(metricGatherer, w, r)
 }
 
-func metricsHandler(w http.ResponseWriter, r *http.Request) {
-	// renders all metrics
-	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(5*float64(time.Second)))
-	defer cancel()
-	r = r.WithContext(ctx)
-	h := promhttp.HandlerFor(sfxRegistry, promhttp.HandlerOpts{})
-	h.ServeHTTP(w, r)
+func metricsHandler(endpoint *scrapeEndpoint, w http.ResponseWriter, r *http.Request) {
+	// renders all metrics, or the ones selected by match[] parameters
+	matches := r.URL.Query()["match[]"]
+	if len(matches) == 0 {
+		endpoint.serveGatherer(sfxGatherer, w, r)
+		return
+	}
+	metricGatherer, err := newSelectingRegistry(sfxGatherer, matches)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	endpoint.serveGatherer(metricGatherer, w, r)
 }
 
-func streamData(sfx config.Sfx, fp config.FlowProgram) error {
+// streamData runs the SignalFlow computation of a flow until it fails or ctx
+// is done
+func streamData(ctx context.Context, cfg *config.Config, fp config.FlowProgram, status *flowStatus) error {
+	sfx := cfg.Sfx
+
 	// initialize flow metrics
 	for _, mt := range fp.MetricTemplates {
-		flowMetricsReceived.WithLabelValues(fp.Name, mt.Stream)
-		flowMetricsFailed.WithLabelValues(fp.Name, mt.Stream)
-		flowMetricsFailed.WithLabelValues(fp.Name, mt.Stream)
+		for _, stream := range mt.Streams() {
+			flowMetricsReceived.WithLabelValues(fp.Name, stream)
+			flowMetricsFailed.WithLabelValues(fp.Name, stream)
+			flowMetricsDropped.WithLabelValues(fp.Name, stream)
+			flowMetricsUnmatched.WithLabelValues(fp.Name, stream)
+		}
+	}
+	flowQueueDepth.WithLabelValues(fp.Name)
+	flowQueueDropped.WithLabelValues(fp.Name)
+	for _, limit := range []string{limitGlobal, limitFlow, limitTemplate} {
+		flowSeriesLimitHit.WithLabelValues(fp.Name, limit)
 	}
 
 	client, err := signalflow.NewClient(
@@ -179,45 +308,58 @@ func streamData(sfx config.Sfx, fp config.FlowProgram) error {
 	if err != nil {
 		return fmt.Errorf("SignalFlow program for %s is invalid - %+s", fp.Name, err)
 	}
-
-	for msg := range comp.Data() {
-		if len(msg.Payloads) == 0 {
-			continue
+	status.setState(flowStateStreaming)
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		// closing the client ends the data channel of the computation
+		select {
+		case <-ctx.Done():
+			client.Close()
+		case <-stopped:
 		}
-		for _, pl := range msg.Payloads {
-			meta := comp.TSIDMetadata(pl.TSID)
-			stream, ok := meta.InternalProperties["sf_streamLabel"].(string)
-			if !ok {
-				stream = "default"
-			}
-			flowMetricsReceived.WithLabelValues(fp.Name, stream).Inc()
-			flowLastReceived.WithLabelValues(fp.Name, stream).SetToCurrentTime()
-			mt, err := fp.GetMetricTemplateForStream(stream)
-			if err != nil {
-				// todo log
-				flowMetricsFailed.WithLabelValues(fp.Name, stream).Inc()
-				continue
-			}
+	}()
+	go func() {
+		// job metadata arrives asynchronously, both calls wait for it
+		status.setJob(comp.Handle(), comp.Resolution())
+	}()
 
-			if mt.Type == "gauge" {
-				gauge, err := getGauge(mt, meta)
-				if err != nil {
-					flowMetricsFailed.WithLabelValues(fp.Name, stream).Inc()
-					// todo log
-				} else {
-					gauge.Set(pl.Float64())
-				}
-			} else if mt.Type == "counter" {
-				counter, err := getCounter(mt, meta)
-				if err != nil {
-					flowMetricsFailed.WithLabelValues(fp.Name, stream).Inc()
-					// todo log
-				} else {
-					counter.Add(pl.Float64())
+	// datapoints are applied to the store by a separate goroutine, so slow
+	// processing doesn't back up the SignalFlow connection
+	queue := newDatapointQueue(fp.Queue)
+	cache := newRenderCache(cfg, fp)
+	sfxStore.setRenderCache(fp.Name, cache)
+	processed := make(chan struct{})
+	go func() {
+		defer close(processed)
+		processQueue(fp, comp, cache, queue, status)
+	}()
+	go func() {
+		// SignalFlow forgets the metadata of expired time series, so their
+		// rendered templates are of no use anymore
+		for {
+			select {
+			case msg := <-comp.Expirations():
+				tsid := idtool.IDFromString(msg.TSID)
+				if rendered := cache.expire(tsid); rendered != nil {
+					sfxStore.removeSources(tsid, rendered)
 				}
+			case <-stopped:
+				return
 			}
 		}
+	}()
+	for msg := range comp.Data() {
+		received := time.Now()
+		for _, pl := range msg.Payloads {
+			if queue.push(queuedDatapoint{payload: pl, timestamp: msg.Timestamp(), received: received}) {
+				flowQueueDropped.WithLabelValues(fp.Name).Inc()
+			}
+		}
+		flowQueueDepth.WithLabelValues(fp.Name).Set(float64(queue.len()))
 	}
+	queue.close()
+	<-processed
 
 	/* signalflow programs without stop timestamp should run forever. if the
 	above loop exists, it implies that the program exited. if comp.Err() is
@@ -230,70 +372,230 @@ func streamData(sfx config.Sfx, fp config.FlowProgram) error {
 	return err
 }
 
-func buildPrometheusMetadata(metric config.PrometheusMetric, sfxMeta *messages.MetadataProperties) (string, []string, []string, error) {
+// processQueue applies the queued datapoints of a flow until the queue is
+// closed and drained
+func processQueue(fp config.FlowProgram, comp *signalflow.Computation, cache *renderCache, queue *datapointQueue, status *flowStatus) {
+	for {
+		dp, ok := queue.pop()
+		if !ok {
+			return
+		}
+		flowQueueDepth.WithLabelValues(fp.Name).Set(float64(queue.len()))
+		pl := dp.payload
+		meta := comp.TSIDMetadata(pl.TSID)
+		if meta == nil {
+			log.Printf("Flow %s received no metadata for TSID %v\n", fp.Name, pl.TSID)
+			flowMetricsFailed.WithLabelValues(fp.Name, "unknown").Inc()
+			continue
+		}
+		rendered := cache.get(pl.TSID, meta)
+		flowMetricsReceived.WithLabelValues(fp.Name, rendered.stream).Inc()
+		flowLastReceived.WithLabelValues(fp.Name, rendered.stream).SetToCurrentTime()
+		status.received(dp.received)
+		if len(rendered.templates) == 0 {
+			flowMetricsUnmatched.WithLabelValues(fp.Name, rendered.stream).Inc()
+			status.unmatched(rendered.stream)
+		}
+		for _, rt := range rendered.templates {
+			processDatapoint(fp, status, rendered.stream, rt, meta, pl)
+		}
+		status.tail.publish(rendered, dp)
+		flowProcessingLatency.WithLabelValues(fp.Name).Observe(time.Since(dp.received).Seconds())
+	}
+}
+
+// processDatapoint applies a datapoint to the store with a rendered metric
+// template
+func processDatapoint(fp config.FlowProgram, status *flowStatus, stream string, rt renderedTemplate, meta *messages.MetadataProperties, pl messages.DataPayload) {
+	for _, v := range rt.violations {
+		flowNamingViolations.WithLabelValues(fp.Name, stream, string(v)).Inc()
+	}
+	if rt.err == errSeriesDropped {
+		flowMetricsDropped.WithLabelValues(fp.Name, stream).Inc()
+		return
+	} else if rt.err != nil {
+		// logged when the time series was rendered
+		flowMetricsFailed.WithLabelValues(fp.Name, stream).Inc()
+		status.errored(rt.err)
+		return
+	}
+
+	mt := rt.template
+	value, ok := mt.TransformValue(payloadValue(pl))
+	if !ok {
+		flowMetricsDropped.WithLabelValues(fp.Name, stream).Inc()
+		return
+	}
+
+	err := applyDatapoint(mt, stream, rt.series, meta, value)
+	var limitErr *seriesLimitError
+	if errors.As(err, &limitErr) {
+		flowSeriesLimitHit.WithLabelValues(fp.Name, limitErr.limit).Inc()
+		if limitErr.first {
+			log.Printf("Flow %s rejects new series - %+s\n", fp.Name, limitErr)
+		}
+		status.errored(limitErr)
+	} else if err != nil {
+		log.Printf("Flow %s failed to process %s for stream %s - %+s\n", fp.Name, mt.Type, stream, err)
+		flowMetricsFailed.WithLabelValues(fp.Name, stream).Inc()
+		status.errored(err)
+	}
+}
+
+// applyDatapoint updates the series in the store according to the metric type
+func applyDatapoint(mt config.PrometheusMetric, stream string, series seriesMetadata, sfxMeta *messages.MetadataProperties, value float64) error {
+	switch mt.Type {
+	case "gauge":
+		return sfxStore.setGauge(series, value)
+	case "counter":
+		return sfxStore.addCounter(series, value)
+	case "info":
+		// info metrics carry their information in labels, the value is always 1
+		return sfxStore.setGauge(series, 1)
+	case "histogram":
+		part := mt.Histogram.PartForStream(stream)
+		bound := 0.0
+		if part == config.ValuePart {
+			// the bound is read from a dimension or property, or from a
+			// SignalFX property like the publish label in sf_streamLabel
+			le, ok := sfxMeta.CustomProperties[mt.Histogram.BucketLabel]
+			if !ok {
+				le, ok = sfxMeta.InternalProperties[mt.Histogram.BucketLabel].(string)
+			}
+			if !ok {
+				return fmt.Errorf("Bucket label %s is missing on histogram %s", mt.Histogram.BucketLabel, series.name)
+			}
+			var err error
+			if bound, err = config.ParseBucketBound(le); err != nil {
+				return err
+			}
+		}
+		return sfxStore.addHistogram(series, mt.Histogram, part, bound, value)
+	case "summary":
+		quantile, _ := mt.Summary.QuantileForStream(stream)
+		return sfxStore.addSummary(series, mt.Summary, mt.Summary.PartForStream(stream), quantile, value)
+	case "stateset":
+		state, ok := mt.StateSet.StateForValue(value)
+		if !ok {
+			return fmt.Errorf("Value %v of %s does not map to a state", value, series.name)
+		}
+		return sfxStore.setState(series, mt.StateSet, state)
+	}
+	return nil
+}
+
+// payloadValue returns the value of a datapoint as float, regardless of the
+// wire type used by SignalFlow
+func payloadValue(pl messages.DataPayload) float64 {
+	switch pl.Type {
+	case messages.ValTypeLong:
+		return float64(pl.Int64())
+	case messages.ValTypeInt:
+		return float64(pl.Int32())
+	default:
+		return pl.Float64()
+	}
+}
+
+// seriesMetadata holds the rendered name and labels of a Prometheus series
+type seriesMetadata struct {
+	name        string
+	help        string
+	unit        string
+	labelNames  []string
+	labelValues []string
+	key         string
+	owner       seriesOwner
+	source      *seriesSource
+}
+
+func buildPrometheusMetadata(fp config.FlowProgram, metric config.PrometheusMetric, naming config.Naming, sfxMeta *messages.MetadataProperties) (seriesMetadata, []config.NamingViolation, error) {
 	// data for template rendering
-	safeMetricName := strings.ReplaceAll(sfxMeta.OriginatingMetric, ".", "_")
-	safeMetricName = strings.ReplaceAll(safeMetricName, ":", "_")
 	templateVars := config.NameTemplateVars{
-		SignalFxMetricName: safeMetricName,
+		SignalFxMetricName: config.SanitizeLabelName(sfxMeta.OriginatingMetric),
 		SignalFxLabels:     sfxMeta.CustomProperties,
 	}
 
 	// build name
 	name, err := metric.GetMetricName(templateVars)
 	if err != nil {
-		return "", nil, nil, err
+		return seriesMetadata{}, nil, err
 	}
 
 	// build labels
-	labelNames := make([]string, len(metric.Labels))
-	labelValues := make([]string, len(metric.Labels))
-	var i = 0
-	for name := range metric.Labels {
-		labelNames[i] = name
-		value, err := metric.GetLabelValue(name, templateVars)
-		if err != nil {
-			return "", nil, nil, err
-		}
-		labelValues[i] = value
-		i++
+	labels, err := metric.GetLabels(templateVars)
+	if err != nil {
+		return seriesMetadata{}, nil, err
 	}
 
-	return name, labelNames, labelValues, nil
-}
-
-func getGauge(metric config.PrometheusMetric, sfxMeta *messages.MetadataProperties) (prometheus.Gauge, error) {
-	name, labelNames, labelValues, err := buildPrometheusMetadata(metric, sfxMeta)
+	// build help
+	help, err := metric.GetHelp(templateVars)
 	if err != nil {
-		return nil, nil
+		return seriesMetadata{}, nil, err
 	}
 
-	// build  or reuse gauge
-	g, ok := sfxGauges[name]
-	if !ok {
-		g = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: name,
-		}, labelNames)
-		sfxGauges[name] = g
-		sfxRegistry.MustRegister(g)
+	// units and info metrics follow the openmetrics naming conventions
+	name = metric.ApplyUnitSuffix(name)
+	if metric.Type == "info" && !strings.HasSuffix(name, "_info") {
+		name = name + "_info"
 	}
-	return g.WithLabelValues(labelValues...), nil
-}
 
-func getCounter(metric config.PrometheusMetric, sfxMeta *messages.MetadataProperties) (prometheus.Counter, error) {
-	name, labelNames, labelValues, err := buildPrometheusMetadata(metric, sfxMeta)
+	// relabel with template rules first, flow rules second
+	labels[config.MetricNameLabel] = name
+	labels = config.Relabel(labels, metric.RelabelConfigs)
+	if labels != nil {
+		labels = config.Relabel(labels, fp.RelabelConfigs)
+	}
+	if labels == nil {
+		return seriesMetadata{}, nil, errSeriesDropped
+	}
+	name, ok := labels[config.MetricNameLabel]
+	if !ok || name == "" {
+		return seriesMetadata{}, nil, fmt.Errorf("Metric name was removed by relabeling")
+	}
+	delete(labels, config.MetricNameLabel)
+
+	// constant labels of the flow
+	for labelName, value := range fp.ConstantLabels() {
+		labels[labelName] = value
+	}
+
+	// histogram buckets, summary quantiles and states are joined into a single series
+	switch metric.Type {
+	case "histogram":
+		delete(labels, "le")
+		delete(labels, config.SanitizeLabelName(metric.Histogram.BucketLabel))
+	case "summary":
+		delete(labels, "quantile")
+	case "stateset":
+		delete(labels, metric.StateSet.Label)
+	}
+
+	// validate rendered names
+	name, labels, violations, err := naming.Apply(metric.Type, name, labels)
 	if err != nil {
-		return nil, nil
+		return seriesMetadata{}, violations, err
 	}
 
-	// build  or reuse gauge
-	c, ok := sfxCounters[name]
-	if !ok {
-		c = prometheus.NewCounterVec(prometheus.CounterOpts{
-			Name: name,
-		}, labelNames)
-		sfxCounters[name] = c
-		sfxRegistry.MustRegister(c)
+	labelNames := config.SortedLabelNames(labels)
+	labelValues := make([]string, len(labelNames))
+	for i, labelName := range labelNames {
+		labelValues[i] = labels[labelName]
 	}
-	return c.WithLabelValues(labelValues...), nil
+
+	return seriesMetadata{
+		name:        name,
+		help:        help,
+		unit:        metric.Unit,
+		labelNames:  labelNames,
+		labelValues: labelValues,
+		key:         seriesKey(labelNames, labelValues),
+		owner: seriesOwner{
+			flow:              fp.Name,
+			flowMaxSeries:     fp.MaxSeries,
+			flowMemoryBudget:  int64(fp.MemoryBudget),
+			template:          metric.ID(),
+			templateMaxSeries: metric.MaxSeries,
+		},
+	}, violations, nil
 }
@@ -0,0 +1,131 @@
+package serve
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"signalfx-prometheus-exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/signalfx/signalfx-go/signalflow/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+func loadFlow(t testing.TB, configFile string) (*config.Config, config.FlowProgram) {
+	cfg, err := config.LoadConfigFromBytes([]byte(configFile))
+	assert.Nil(t, err)
+	return cfg, cfg.Flows[0]
+}
+
+func TestBuildInfoMetadata(t *testing.T) {
+	cfg, fp := loadFlow(t, `---
+externalLabels:
+  source: signalfx
+flows:
+- name: catchpoint-data
+  query: data('catchpoint.responsetime').publish()
+  prometheusMetricTemplates:
+  - type: info
+    name: catchpoint_test
+    labels:
+      instance: '{{ .SignalFxLabels.cp_testname }}'
+      owner: '{{ .SignalFxLabels.owner }}'
+`)
+	mt, _ := fp.GetMetricTemplateForStream("default")
+
+	series, violations, err := buildPrometheusMetadata(fp, mt, cfg.Naming, &messages.MetadataProperties{
+		OriginatingMetric: "catchpoint.responsetime",
+		CustomProperties:  map[string]string{"cp_testname": "abc", "owner": "team"},
+	})
+	assert.Nil(t, err)
+	assert.Empty(t, violations)
+	assert.Equal(t, "catchpoint_test_info", series.name)
+	assert.Equal(t, []string{"instance", "owner", "source"}, series.labelNames)
+	assert.Equal(t, []string{"abc", "team", "signalfx"}, series.labelValues)
+}
+
+func TestBuildHelpAndUnit(t *testing.T) {
+	cfg, fp := loadFlow(t, `---
+flows:
+- name: catchpoint-data
+  query: data('catchpoint.responsetime').publish()
+  prometheusMetricTemplates:
+  - type: counter
+    name: catchpoint_response_time_total
+    help: 'Response time of {{ .SignalFxMetricName }}'
+    unit: seconds
+`)
+	mt, _ := fp.GetMetricTemplateForStream("default")
+
+	series, _, err := buildPrometheusMetadata(fp, mt, cfg.Naming, &messages.MetadataProperties{
+		OriginatingMetric: "catchpoint.responsetime",
+		CustomProperties:  map[string]string{},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "catchpoint_response_time_seconds_total", series.name)
+	assert.Equal(t, "Response time of catchpoint_responsetime", series.help)
+
+	store := newSeriesStore()
+	assert.Nil(t, store.addCounter(series, 1))
+	mf := gatherStore(t, store)["catchpoint_response_time_seconds_total"]
+	var text bytes.Buffer
+	_, err = expfmt.MetricFamilyToText(&text, mf)
+	assert.Nil(t, err)
+	assert.Contains(t, text.String(), "# HELP catchpoint_response_time_seconds_total Response time of catchpoint_responsetime\n")
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(store)
+	units := &UnitRegistry{Registry: registry, Store: store}
+	selecting, err := newSelectingRegistry(units, []string{"catchpoint_response_time_seconds_total"})
+	assert.Nil(t, err)
+	mfs, err := selecting.Gather()
+	assert.Nil(t, err)
+	assert.Len(t, mfs, 1)
+	assert.Equal(t, "seconds", mfs[0].GetUnit())
+
+	w := scrape(newScrapeEndpoint(config.ScrapeOptions{OpenMetrics: true}), units, "application/openmetrics-text; version=1.0.0")
+	assert.Equal(t, http.StatusOK, w.Code)
+	openMetrics := w.Body.String()
+	assert.Contains(t, openMetrics, "# HELP catchpoint_response_time_seconds Response time of catchpoint_responsetime\n")
+	assert.Contains(t, openMetrics, "# TYPE catchpoint_response_time_seconds counter\n")
+	assert.Contains(t, openMetrics, "# UNIT catchpoint_response_time_seconds seconds\n")
+	assert.Contains(t, openMetrics, "catchpoint_response_time_seconds_total 1.0\n")
+
+	// the text format has no unit metadata
+	w = scrape(newScrapeEndpoint(config.ScrapeOptions{OpenMetrics: true}), units, "")
+	assert.NotContains(t, w.Body.String(), "# UNIT")
+}
+
+func TestApplyHistogramStreamLabelBound(t *testing.T) {
+	_, fp := loadFlow(t, `---
+flows:
+- name: stream-label-histogram
+  query: data('request.duration.bucket').publish('0.5')
+  prometheusMetricTemplates:
+  - streamRegex: '.*'
+    type: histogram
+    name: stream_label_duration_seconds
+    histogram:
+      bucketLabel: sf_streamLabel
+      buckets: ['0.5', '+Inf']
+`)
+	mt := fp.MetricTemplates[0]
+	series := seriesMetadata{name: "stream_label_duration_seconds", owner: seriesOwner{flow: fp.Name, template: mt.ID()}}
+	meta := func(stream string) *messages.MetadataProperties {
+		return &messages.MetadataProperties{
+			InternalProperties: map[string]interface{}{"sf_streamLabel": stream},
+			CustomProperties:   map[string]string{},
+		}
+	}
+
+	assert.Nil(t, applyDatapoint(mt, "0.5", series, meta("0.5"), 2))
+	assert.Nil(t, applyDatapoint(mt, "+Inf", series, meta("+Inf"), 3))
+	assert.NotNil(t, applyDatapoint(mt, "1", series, meta("1"), 1))
+
+	histogram := gatherStore(t, sfxStore)["stream_label_duration_seconds"].Metric[0].Histogram
+	assert.Equal(t, uint64(3), histogram.GetSampleCount())
+	assert.Equal(t, 1, len(histogram.Bucket))
+	assert.Equal(t, uint64(2), histogram.Bucket[0].GetCumulativeCount())
+}
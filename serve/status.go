@@ -0,0 +1,221 @@
+package serve
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"signalfx-prometheus-exporter/config"
+)
+
+const (
+	flowStateConnecting = "connecting"
+	flowStateStreaming  = "streaming"
+	flowStateFailed     = "failed"
+	flowStatePaused     = "paused"
+)
+
+// flowStatus tracks what streamData sees of a flow for the status page and
+// the flows API
+type flowStatus struct {
+	mu               sync.Mutex
+	flow             config.FlowProgram
+	state            string
+	jobID            string
+	resolution       time.Duration
+	lastData         time.Time
+	lastError        string
+	restarts         int
+	unmatchedStreams map[string]bool
+	tail             *flowTail
+}
+
+// flowStatuses holds the status of all flows by name
+var flowStatuses = struct {
+	sync.Mutex
+	flows map[string]*flowStatus
+}{flows: make(map[string]*flowStatus)}
+
+// statusOf returns the status of a flow, creating it on first use
+func statusOf(fp config.FlowProgram) *flowStatus {
+	flowStatuses.Lock()
+	defer flowStatuses.Unlock()
+	status, ok := flowStatuses.flows[fp.Name]
+	if !ok {
+		status = &flowStatus{
+			flow:             fp,
+			state:            flowStateConnecting,
+			unmatchedStreams: make(map[string]bool),
+			tail:             newFlowTail(),
+		}
+		flowStatuses.flows[fp.Name] = status
+	}
+	return status
+}
+
+func (fs *flowStatus) setState(state string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.state = state
+}
+
+func (fs *flowStatus) setJob(jobID string, resolution time.Duration) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.jobID = jobID
+	fs.resolution = resolution
+}
+
+func (fs *flowStatus) received(at time.Time) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.lastData = at
+}
+
+func (fs *flowStatus) unmatched(stream string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.unmatchedStreams[stream] = true
+}
+
+// restarted counts a restart of the flow
+func (fs *flowStatus) restarted() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.restarts++
+}
+
+// errored records an error of a datapoint the flow failed to process
+func (fs *flowStatus) errored(err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.lastError = err.Error()
+}
+
+// failed records the error that stopped the flow
+func (fs *flowStatus) failed(err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.state = flowStateFailed
+	fs.lastError = err.Error()
+}
+
+// TemplateStatus is the status of a metric template in the flows API
+type TemplateStatus struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Series int    `json:"series"`
+}
+
+// FlowStatus is the status of a flow in the flows API
+type FlowStatus struct {
+	Name             string           `json:"name"`
+	Query            string           `json:"query"`
+	State            string           `json:"state"`
+	JobID            string           `json:"jobId"`
+	Resolution       string           `json:"resolution"`
+	LastData         *time.Time       `json:"lastData"`
+	LastError        string           `json:"lastError"`
+	Restarts         int              `json:"restarts"`
+	Templates        []TemplateStatus `json:"templates"`
+	UnmatchedStreams []string         `json:"unmatchedStreams"`
+}
+
+func (fs *flowStatus) snapshot(seriesByTemplate map[string]int) FlowStatus {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	status := FlowStatus{
+		Name:             fs.flow.Name,
+		Query:            fs.flow.Query,
+		State:            fs.state,
+		JobID:            fs.jobID,
+		Resolution:       fs.resolution.String(),
+		LastError:        fs.lastError,
+		Restarts:         fs.restarts,
+		Templates:        make([]TemplateStatus, len(fs.flow.MetricTemplates)),
+		UnmatchedStreams: make([]string, 0, len(fs.unmatchedStreams)),
+	}
+	if !fs.lastData.IsZero() {
+		lastData := fs.lastData
+		status.LastData = &lastData
+	}
+	for i, mt := range fs.flow.MetricTemplates {
+		status.Templates[i] = TemplateStatus{
+			ID:     mt.ID(),
+			Name:   mt.Name,
+			Type:   mt.Type,
+			Series: seriesByTemplate[mt.ID()],
+		}
+	}
+	for stream := range fs.unmatchedStreams {
+		status.UnmatchedStreams = append(status.UnmatchedStreams, stream)
+	}
+	sort.Strings(status.UnmatchedStreams)
+	return status
+}
+
+// flowsStatus returns the status of all flows ordered by name
+func flowsStatus() []FlowStatus {
+	seriesByTemplate := sfxStore.seriesByTemplate()
+	flowStatuses.Lock()
+	defer flowStatuses.Unlock()
+	statuses := make([]FlowStatus, 0, len(flowStatuses.flows))
+	for _, fs := range flowStatuses.flows {
+		statuses = append(statuses, fs.snapshot(seriesByTemplate))
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+// flowsAPIHandler renders the status of all flows as JSON
+func flowsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	response := struct {
+		Status string       `json:"status"`
+		Data   []FlowStatus `json:"data"`
+	}{Status: "success", Data: flowsStatus()}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Failed to render flows API response - %+s\n", err)
+	}
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>SignalFX Prometheus exporter status</title></head>
+<body>
+<h1>Flows</h1>
+{{ range . }}
+<h2>{{ .Name }}</h2>
+<table>
+<tr><th align="left">Query</th><td><pre>{{ .Query }}</pre></td></tr>
+<tr><th align="left">State</th><td>{{ .State }}</td></tr>
+<tr><th align="left">Job ID</th><td>{{ .JobID }}</td></tr>
+<tr><th align="left">Resolution</th><td>{{ .Resolution }}</td></tr>
+<tr><th align="left">Last data</th><td>{{ with .LastData }}{{ .Format "2006-01-02T15:04:05Z07:00" }}{{ else }}never{{ end }}</td></tr>
+<tr><th align="left">Last error</th><td>{{ .LastError }}</td></tr>
+<tr><th align="left">Restarts</th><td>{{ .Restarts }}</td></tr>
+<tr><th align="left">Unmatched streams</th><td>{{ range .UnmatchedStreams }}{{ . }} {{ end }}</td></tr>
+</table>
+<table>
+<tr><th align="left">Template</th><th align="left">Name</th><th align="left">Type</th><th align="left">Series</th></tr>
+{{ range .Templates }}<tr><td>{{ .ID }}</td><td>{{ .Name }}</td><td>{{ .Type }}</td><td>{{ .Series }}</td></tr>
+{{ end }}</table>
+{{ end }}
+</body>
+</html>
+`))
+
+// statusHandler renders the status of all flows as HTML page
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, flowsStatus()); err != nil {
+		log.Printf("Failed to render status page - %+s\n", err)
+	}
+}
@@ -0,0 +1,95 @@
+package serve
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/signalfx/signalfx-go/signalflow/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlowsAPI(t *testing.T) {
+	_, fp := loadFlow(t, `---
+flows:
+- name: status-flow
+  query: data('catchpoint.responsetime').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    name: catchpoint_response_time
+`)
+	status := statusOf(fp)
+	assert.Same(t, status, statusOf(fp))
+	status.setState(flowStateStreaming)
+	status.setJob("job-1", 10*time.Second)
+	status.received(time.Now())
+	status.unmatched("errors")
+	status.failed(errors.New("connection lost"))
+
+	sfxStore.mu.Lock()
+	sfxStore.counts.add(seriesOwner{flow: fp.Name, template: fp.MetricTemplates[0].ID()})
+	sfxStore.mu.Unlock()
+
+	w := httptest.NewRecorder()
+	flowsAPIHandler(w, httptest.NewRequest(http.MethodGet, "/api/v1/flows", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response struct {
+		Status string       `json:"status"`
+		Data   []FlowStatus `json:"data"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "success", response.Status)
+
+	var flow *FlowStatus
+	for i := range response.Data {
+		if response.Data[i].Name == fp.Name {
+			flow = &response.Data[i]
+		}
+	}
+	assert.NotNil(t, flow)
+	assert.Equal(t, flowStateFailed, flow.State)
+	assert.Equal(t, "job-1", flow.JobID)
+	assert.Equal(t, "10s", flow.Resolution)
+	assert.NotNil(t, flow.LastData)
+	assert.Equal(t, "connection lost", flow.LastError)
+	assert.Equal(t, []string{"errors"}, flow.UnmatchedStreams)
+	assert.Equal(t, []TemplateStatus{{ID: "status-flow/0", Name: "catchpoint_response_time", Type: "gauge", Series: 1}}, flow.Templates)
+
+	w = httptest.NewRecorder()
+	statusHandler(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "<h2>status-flow</h2>")
+	assert.Contains(t, w.Body.String(), "connection lost")
+}
+
+func TestFlowLastError(t *testing.T) {
+	flowMetricsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "failed"}, []string{"flow", "stream"})
+	_, fp := loadFlow(t, `---
+flows:
+- name: error-flow
+  query: data('catchpoint.errors').publish()
+  prometheusMetricTemplates:
+  - type: counter
+    name: catchpoint_errors_total
+`)
+	status := statusOf(fp)
+	mt := fp.MetricTemplates[0]
+
+	// render errors are recorded for every failed datapoint
+	processDatapoint(fp, status, "default", renderedTemplate{template: mt, err: errors.New("render failed")}, nil, messages.DataPayload{})
+	assert.Equal(t, "render failed", status.snapshot(nil).LastError)
+
+	// as are errors applying a datapoint to the store
+	var pl messages.DataPayload
+	binary.BigEndian.PutUint64(pl.Val[:], math.Float64bits(-1))
+	series := seriesMetadata{name: "catchpoint_errors_total", owner: seriesOwner{flow: fp.Name, template: mt.ID()}}
+	processDatapoint(fp, status, "default", renderedTemplate{template: mt, series: series}, nil, pl)
+	assert.Contains(t, status.snapshot(nil).LastError, "can't be decreased")
+	assert.NotEqual(t, flowStateFailed, status.snapshot(nil).State)
+}
@@ -0,0 +1,415 @@
+package serve
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"signalfx-prometheus-exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/signalfx/signalfx-go/idtool"
+)
+
+// seriesStore holds the state of all series built from SignalFx data and
+// exposes them as Prometheus metrics. The store is an unchecked collector
+// since the series it holds are only known at runtime.
+type seriesStore struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+	counts   seriesCounts
+	flows    map[string]*flowUsage
+}
+
+type metricFamily struct {
+	metricType string
+	help       string
+	unit       string
+	series     map[string]*series
+}
+
+type series struct {
+	owner       seriesOwner
+	family      string
+	key         string
+	bytes       int64
+	lruElement  *list.Element
+	desc        *prometheus.Desc
+	labelNames  []string
+	labelValues []string
+	sources     map[idtool.ID]*seriesSource
+	value       float64
+	histogram   *histogramState
+	summary     *summaryState
+	stateset    *statesetState
+}
+
+// histogramState accumulates the parts of a histogram that arrive as
+// individual SignalFx datapoints
+type histogramState struct {
+	config   *config.Histogram
+	buckets  map[float64]float64
+	sum      float64
+	count    float64
+	hasSum   bool
+	hasCount bool
+}
+
+func newSeriesStore() *seriesStore {
+	return &seriesStore{
+		families: make(map[string]*metricFamily),
+		counts:   newSeriesCounts(),
+		flows:    make(map[string]*flowUsage),
+	}
+}
+
+// seriesByTemplate returns the number of series created by each template
+func (s *seriesStore) seriesByTemplate() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[string]int, len(s.counts.byTemplate))
+	for template, count := range s.counts.byTemplate {
+		counts[template] = count
+	}
+	return counts
+}
+
+// setMaxSeries limits the number of series in the store across all flows
+func (s *seriesStore) setMaxSeries(maxSeries int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts.maxSeries = maxSeries
+}
+
+func seriesKey(labelNames []string, labelValues []string) string {
+	var key strings.Builder
+	for i := range labelNames {
+		key.WriteString(labelNames[i])
+		key.WriteByte(0xff)
+		key.WriteString(labelValues[i])
+		key.WriteByte(0xff)
+	}
+	return key.String()
+}
+
+// getSeries returns the series for the metadata or creates it if the series
+// limits allow it. Must be called with the lock held.
+func (s *seriesStore) getSeries(metricType string, meta seriesMetadata) (*series, error) {
+	family, ok := s.families[meta.name]
+	if ok && family.metricType != metricType {
+		return nil, fmt.Errorf("Metric %s already exists as %s, can't use it as %s", meta.name, family.metricType, metricType)
+	}
+
+	// rendered metadata carries its key, metadata built by hand doesn't
+	key := meta.key
+	if key == "" {
+		key = seriesKey(meta.labelNames, meta.labelValues)
+	}
+	if ok {
+		if ser, ok := family.series[key]; ok {
+			s.touch(ser)
+			s.addSource(ser, meta.source)
+			return ser, nil
+		}
+	}
+
+	if err := s.counts.admit(meta.owner); err != nil {
+		return nil, err
+	}
+	if !ok {
+		// all series of a family share the help text of the first series
+		family = &metricFamily{metricType: metricType, help: meta.help, unit: meta.unit, series: make(map[string]*series)}
+		s.families[meta.name] = family
+	}
+	ser := &series{
+		owner:       meta.owner,
+		family:      meta.name,
+		key:         key,
+		bytes:       seriesBytes(meta, key),
+		desc:        prometheus.NewDesc(meta.name, family.help, meta.labelNames, nil),
+		labelNames:  meta.labelNames,
+		labelValues: meta.labelValues,
+	}
+	family.series[key] = ser
+	s.counts.add(meta.owner)
+	s.track(ser)
+	s.addSource(ser, meta.source)
+	return ser, nil
+}
+
+func (s *seriesStore) setGauge(meta seriesMetadata, value float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ser, err := s.getSeries("gauge", meta)
+	if err != nil {
+		return err
+	}
+	ser.value = value
+	return nil
+}
+
+func (s *seriesStore) addCounter(meta seriesMetadata, value float64) error {
+	if value < 0 {
+		return fmt.Errorf("Counter %s can't be decreased by %v", meta.name, value)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ser, err := s.getSeries("counter", meta)
+	if err != nil {
+		return err
+	}
+	ser.value += value
+	return nil
+}
+
+// addHistogram adds a datapoint to a bucket, the sum or the count of a
+// histogram. Bucket values are counted like counter increments.
+func (s *seriesStore) addHistogram(meta seriesMetadata, hcfg *config.Histogram, part config.StreamPart, bound float64, value float64) error {
+	if value < 0 && part != config.SumPart {
+		return fmt.Errorf("Histogram %s can't be decreased by %v", meta.name, value)
+	}
+	if part == config.ValuePart && !hcfg.HasBucket(bound) {
+		return fmt.Errorf("Bucket %v is not declared for histogram %s", bound, meta.name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ser, err := s.getSeries("histogram", meta)
+	if err != nil {
+		return err
+	}
+	if ser.histogram == nil {
+		ser.histogram = &histogramState{config: hcfg, buckets: make(map[float64]float64)}
+		s.grow(ser, int64(len(hcfg.BucketBounds())*valueBytes))
+	}
+	h := ser.histogram
+	switch part {
+	case config.SumPart:
+		h.sum += value
+		h.hasSum = true
+	case config.CountPart:
+		h.count += value
+		h.hasCount = true
+	default:
+		h.buckets[bound] += value
+	}
+	return nil
+}
+
+// complete reports whether all parts of the histogram have been received
+func (h *histogramState) complete() bool {
+	for _, bound := range h.config.BucketBounds() {
+		if _, ok := h.buckets[bound]; !ok {
+			return false
+		}
+	}
+	if h.config.SumStream != "" && !h.hasSum {
+		return false
+	}
+	if h.config.CountStream != "" && !h.hasCount {
+		return false
+	}
+	return true
+}
+
+func (h *histogramState) metric(desc *prometheus.Desc, labelValues []string) (prometheus.Metric, error) {
+	buckets := make(map[float64]uint64, len(h.buckets))
+	for bound, count := range h.buckets {
+		if !math.IsInf(bound, +1) {
+			buckets[bound] = uint64(math.Round(count))
+		}
+	}
+	count := h.buckets[math.Inf(+1)]
+	if h.hasCount {
+		count = h.count
+	}
+	sum := math.NaN()
+	if h.hasSum {
+		sum = h.sum
+	}
+	return prometheus.NewConstHistogram(desc, uint64(math.Round(count)), sum, buckets, labelValues...)
+}
+
+// summaryState joins the quantiles of a summary that arrive as individual
+// SignalFx streams
+type summaryState struct {
+	config    *config.Summary
+	quantiles map[float64]float64
+	sum       float64
+	count     float64
+	hasSum    bool
+	hasCount  bool
+}
+
+// addSummary sets a quantile of a summary or adds a datapoint to its sum or
+// count. Sum and count values are counted like counter increments.
+func (s *seriesStore) addSummary(meta seriesMetadata, scfg *config.Summary, part config.StreamPart, quantile float64, value float64) error {
+	if value < 0 && part == config.CountPart {
+		return fmt.Errorf("Summary count %s can't be decreased by %v", meta.name, value)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ser, err := s.getSeries("summary", meta)
+	if err != nil {
+		return err
+	}
+	if ser.summary == nil {
+		ser.summary = &summaryState{config: scfg, quantiles: make(map[float64]float64)}
+		s.grow(ser, int64(len(scfg.Quantiles)*valueBytes))
+	}
+	sm := ser.summary
+	switch part {
+	case config.SumPart:
+		sm.sum += value
+		sm.hasSum = true
+	case config.CountPart:
+		sm.count += value
+		sm.hasCount = true
+	default:
+		sm.quantiles[quantile] = value
+	}
+	return nil
+}
+
+// complete reports whether all quantiles of the summary have been received,
+// as well as the sum and count if their streams are configured
+func (sm *summaryState) complete() bool {
+	for _, quantile := range sm.config.Quantiles {
+		if _, ok := sm.quantiles[quantile]; !ok {
+			return false
+		}
+	}
+	if sm.config.SumStream != "" && !sm.hasSum {
+		return false
+	}
+	if sm.config.CountStream != "" && !sm.hasCount {
+		return false
+	}
+	return true
+}
+
+func (sm *summaryState) metric(desc *prometheus.Desc, labelValues []string) (prometheus.Metric, error) {
+	quantiles := make(map[float64]float64, len(sm.quantiles))
+	for quantile, value := range sm.quantiles {
+		quantiles[quantile] = value
+	}
+	sum := math.NaN()
+	if sm.hasSum {
+		sum = sm.sum
+	}
+	return prometheus.NewConstSummary(desc, uint64(math.Round(sm.count)), sum, quantiles, labelValues...)
+}
+
+// statesetState holds the current state of a state set
+type statesetState struct {
+	config  *config.StateSet
+	current string
+}
+
+// setState switches a state set to a new state
+func (s *seriesStore) setState(meta seriesMetadata, scfg *config.StateSet, state string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ser, err := s.getSeries("stateset", meta)
+	if err != nil {
+		return err
+	}
+	if ser.stateset == nil {
+		// every state is exposed as its own series with an additional state label
+		labelNames := append(append([]string{}, meta.labelNames...), scfg.Label)
+		ser.desc = prometheus.NewDesc(meta.name, s.families[meta.name].help, labelNames, nil)
+		ser.stateset = &statesetState{config: scfg}
+		s.grow(ser, int64(len(scfg.StateNames())*valueBytes))
+	}
+	ser.stateset.current = state
+	return nil
+}
+
+func (ss *statesetState) metrics(desc *prometheus.Desc, labelValues []string) ([]prometheus.Metric, error) {
+	metrics := make([]prometheus.Metric, 0, len(ss.config.StateNames()))
+	for _, state := range ss.config.StateNames() {
+		value := 0.0
+		if state == ss.current {
+			value = 1
+		}
+		metric, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, value, append(append([]string{}, labelValues...), state)...)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics, nil
+}
+
+func (s *seriesStore) Describe(ch chan<- *prometheus.Desc) {
+	// unchecked collector
+}
+
+// metrics builds the Prometheus metrics of a series. Histograms and summaries
+// that are not complete yet yield no metrics.
+func (ser *series) metrics(metricType string) ([]prometheus.Metric, error) {
+	var metric prometheus.Metric
+	var err error
+	switch metricType {
+	case "gauge":
+		metric, err = prometheus.NewConstMetric(ser.desc, prometheus.GaugeValue, ser.value, ser.labelValues...)
+	case "counter":
+		metric, err = prometheus.NewConstMetric(ser.desc, prometheus.CounterValue, ser.value, ser.labelValues...)
+	case "histogram":
+		if !ser.histogram.complete() {
+			return nil, nil
+		}
+		metric, err = ser.histogram.metric(ser.desc, ser.labelValues)
+	case "summary":
+		if !ser.summary.complete() {
+			return nil, nil
+		}
+		metric, err = ser.summary.metric(ser.desc, ser.labelValues)
+	case "stateset":
+		return ser.stateset.metrics(ser.desc, ser.labelValues)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []prometheus.Metric{metric}, nil
+}
+
+// units returns the OpenMetrics unit of the metric families that have one
+func (s *seriesStore) units() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	units := make(map[string]string)
+	for name, family := range s.families {
+		if family.unit != "" {
+			units[name] = family.unit
+		}
+	}
+	return units
+}
+
+func (s *seriesStore) Collect(ch chan<- prometheus.Metric) {
+	s.collect(ch, nil)
+}
+
+// collect sends the metrics of the series owned by the flows, or of all
+// series if flows is nil
+func (s *seriesStore) collect(ch chan<- prometheus.Metric, flows map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, family := range s.families {
+		for _, ser := range family.series {
+			if flows != nil && !flows[ser.owner.flow] {
+				continue
+			}
+			metrics, err := ser.metrics(family.metricType)
+			if err != nil {
+				ch <- prometheus.NewInvalidMetric(ser.desc, err)
+				continue
+			}
+			for _, metric := range metrics {
+				ch <- metric
+			}
+		}
+	}
+}
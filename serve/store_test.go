@@ -0,0 +1,156 @@
+package serve
+
+import (
+	"math"
+	"testing"
+
+	"signalfx-prometheus-exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func gatherStore(t *testing.T, store *seriesStore) map[string]*dto.MetricFamily {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(store)
+	mfs, err := registry.Gather()
+	assert.Nil(t, err)
+	byName := make(map[string]*dto.MetricFamily, len(mfs))
+	for _, mf := range mfs {
+		byName[mf.GetName()] = mf
+	}
+	return byName
+}
+
+func TestStoreGaugeAndCounter(t *testing.T) {
+	store := newSeriesStore()
+	meta := seriesMetadata{name: "some_gauge", labelNames: []string{"instance"}, labelValues: []string{"a"}}
+	assert.Nil(t, store.setGauge(meta, 1))
+	assert.Nil(t, store.setGauge(meta, 2))
+
+	meta = seriesMetadata{name: "some_counter", labelNames: []string{"instance"}, labelValues: []string{"a"}}
+	assert.Nil(t, store.addCounter(meta, 1))
+	assert.Nil(t, store.addCounter(meta, 2))
+	assert.NotNil(t, store.addCounter(meta, -1))
+	assert.NotNil(t, store.setGauge(meta, 1))
+
+	mfs := gatherStore(t, store)
+	assert.Equal(t, 2.0, mfs["some_gauge"].Metric[0].Gauge.GetValue())
+	assert.Equal(t, 3.0, mfs["some_counter"].Metric[0].Counter.GetValue())
+}
+
+func TestStoreHistogram(t *testing.T) {
+	hcfg := &config.Histogram{Buckets: []string{"0.1", "1"}, SumStream: "sum"}
+	assert.Nil(t, hcfg.Validate())
+
+	store := newSeriesStore()
+	meta := seriesMetadata{name: "latency_seconds", labelNames: []string{"instance"}, labelValues: []string{"a"}}
+	assert.Nil(t, store.addHistogram(meta, hcfg, config.ValuePart, 0.1, 1))
+	assert.Nil(t, store.addHistogram(meta, hcfg, config.ValuePart, 1, 3))
+	// bounds that are not declared would add buckets to the histogram
+	assert.NotNil(t, store.addHistogram(meta, hcfg, config.ValuePart, 0.5, 2))
+
+	// incomplete histograms are not exposed
+	assert.Equal(t, 0, testutil.CollectAndCount(store))
+
+	assert.Nil(t, store.addHistogram(meta, hcfg, config.ValuePart, math.Inf(+1), 4))
+	assert.Equal(t, 0, testutil.CollectAndCount(store))
+
+	assert.Nil(t, store.addHistogram(meta, hcfg, config.SumPart, 0, 2.5))
+	assert.Nil(t, store.addHistogram(meta, hcfg, config.ValuePart, math.Inf(+1), 1))
+
+	histogram := gatherStore(t, store)["latency_seconds"].Metric[0].Histogram
+	assert.Equal(t, uint64(5), histogram.GetSampleCount())
+	assert.Equal(t, 2.5, histogram.GetSampleSum())
+	assert.Equal(t, 2, len(histogram.Bucket))
+	assert.Equal(t, 0.1, histogram.Bucket[0].GetUpperBound())
+	assert.Equal(t, uint64(1), histogram.Bucket[0].GetCumulativeCount())
+	assert.Equal(t, 1.0, histogram.Bucket[1].GetUpperBound())
+	assert.Equal(t, uint64(3), histogram.Bucket[1].GetCumulativeCount())
+}
+
+func TestStoreSummary(t *testing.T) {
+	scfg := &config.Summary{
+		Quantiles:   map[string]float64{"p50": 0.5, "p99": 0.99},
+		CountStream: "count",
+	}
+	assert.Nil(t, scfg.Validate())
+
+	store := newSeriesStore()
+	meta := seriesMetadata{name: "latency_seconds", labelNames: []string{"instance"}, labelValues: []string{"a"}}
+	assert.Nil(t, store.addSummary(meta, scfg, config.ValuePart, 0.5, 0.2))
+	assert.Nil(t, store.addSummary(meta, scfg, config.CountPart, 0, 10))
+
+	// incomplete summaries are not exposed
+	assert.Equal(t, 0, testutil.CollectAndCount(store))
+
+	assert.Nil(t, store.addSummary(meta, scfg, config.ValuePart, 0.99, 1.5))
+	assert.Nil(t, store.addSummary(meta, scfg, config.ValuePart, 0.5, 0.3))
+	assert.Nil(t, store.addSummary(meta, scfg, config.CountPart, 0, 5))
+
+	summary := gatherStore(t, store)["latency_seconds"].Metric[0].Summary
+	assert.Equal(t, uint64(15), summary.GetSampleCount())
+	assert.True(t, math.IsNaN(summary.GetSampleSum()))
+	assert.Equal(t, 2, len(summary.Quantile))
+	assert.Equal(t, 0.5, summary.Quantile[0].GetQuantile())
+	assert.Equal(t, 0.3, summary.Quantile[0].GetValue())
+	assert.Equal(t, 0.99, summary.Quantile[1].GetQuantile())
+	assert.Equal(t, 1.5, summary.Quantile[1].GetValue())
+}
+
+func TestStoreStateSet(t *testing.T) {
+	scfg := &config.StateSet{States: map[string]string{"0": "ok", "1": "warn", "2": "critical"}}
+	assert.Nil(t, scfg.Validate())
+
+	store := newSeriesStore()
+	meta := seriesMetadata{name: "check_status", labelNames: []string{"instance"}, labelValues: []string{"a"}}
+	assert.Nil(t, store.setState(meta, scfg, "ok"))
+	assert.Nil(t, store.setState(meta, scfg, "warn"))
+
+	states := map[string]float64{}
+	for _, m := range gatherStore(t, store)["check_status"].Metric {
+		for _, l := range m.GetLabel() {
+			if l.GetName() == "state" {
+				states[l.GetValue()] = m.Gauge.GetValue()
+			}
+		}
+	}
+	assert.Equal(t, map[string]float64{"ok": 0, "warn": 1, "critical": 0}, states)
+}
+
+func TestStoreSeriesLimits(t *testing.T) {
+	store := newSeriesStore()
+	store.setMaxSeries(4)
+	owner := seriesOwner{flow: "flow-a", flowMaxSeries: 3, template: "flow-a/0", templateMaxSeries: 2}
+	gauge := func(owner seriesOwner, instance string) seriesMetadata {
+		return seriesMetadata{name: "some_gauge", labelNames: []string{"instance"}, labelValues: []string{instance}, owner: owner}
+	}
+	limitHit := func(err error) *seriesLimitError {
+		var limitErr *seriesLimitError
+		assert.ErrorAs(t, err, &limitErr)
+		return limitErr
+	}
+
+	assert.Nil(t, store.setGauge(gauge(owner, "a"), 1))
+	assert.Nil(t, store.setGauge(gauge(owner, "b"), 1))
+	err := limitHit(store.setGauge(gauge(owner, "c"), 1))
+	assert.Equal(t, limitTemplate, err.limit)
+	assert.True(t, err.first)
+	assert.False(t, limitHit(store.setGauge(gauge(owner, "c"), 1)).first)
+
+	// existing series keep updating
+	assert.Nil(t, store.setGauge(gauge(owner, "a"), 2))
+
+	owner.template = "flow-a/1"
+	assert.Nil(t, store.setGauge(gauge(owner, "c"), 1))
+	assert.Equal(t, limitFlow, limitHit(store.setGauge(gauge(owner, "d"), 1)).limit)
+
+	other := seriesOwner{flow: "flow-b", template: "flow-b/0"}
+	assert.Nil(t, store.setGauge(gauge(other, "d"), 1))
+	assert.Equal(t, limitGlobal, limitHit(store.setGauge(gauge(other, "e"), 1)).limit)
+
+	mfs := gatherStore(t, store)
+	assert.Len(t, mfs["some_gauge"].Metric, 4)
+}
@@ -0,0 +1,202 @@
+package serve
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"signalfx-prometheus-exporter/config"
+
+	"github.com/gorilla/mux"
+)
+
+// tailBufferSize is the number of events buffered per tail subscriber.
+// Events are dropped for subscribers that don't keep up.
+const tailBufferSize = 256
+
+// TailEvent is a datapoint of a flow as streamed by the tail endpoint
+type TailEvent struct {
+	TSID       string            `json:"tsid"`
+	Stream     string            `json:"stream"`
+	Dimensions map[string]string `json:"dimensions"`
+	Metrics    []TailMetric      `json:"metrics"`
+	Value      string            `json:"value"`
+	Timestamp  time.Time         `json:"timestamp"`
+}
+
+// TailMetric is the metric a template rendered for a datapoint
+type TailMetric struct {
+	Template string            `json:"template"`
+	Name     string            `json:"name,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+type tailSubscriber struct {
+	matchers   []config.Matcher
+	sampleRate float64
+	events     chan TailEvent
+}
+
+// flowTail fans out the datapoints of a flow to the subscribers of the tail
+// endpoint
+type flowTail struct {
+	mu          sync.Mutex
+	subscribers map[*tailSubscriber]bool
+	active      int32
+}
+
+func newFlowTail() *flowTail {
+	return &flowTail{subscribers: make(map[*tailSubscriber]bool)}
+}
+
+func (ft *flowTail) subscribe(sub *tailSubscriber) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.subscribers[sub] = true
+	atomic.StoreInt32(&ft.active, int32(len(ft.subscribers)))
+}
+
+func (ft *flowTail) unsubscribe(sub *tailSubscriber) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	delete(ft.subscribers, sub)
+	atomic.StoreInt32(&ft.active, int32(len(ft.subscribers)))
+}
+
+// publish sends a datapoint to all subscribers whose filter matches. Without
+// subscribers no event is built.
+func (ft *flowTail) publish(rendered *renderedTimeSeries, dp queuedDatapoint) {
+	if atomic.LoadInt32(&ft.active) == 0 {
+		return
+	}
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	var event *TailEvent
+	for sub := range ft.subscribers {
+		if rand.Float64() >= sub.sampleRate {
+			continue
+		}
+		if !config.MatchAll(sub.matchers, rendered.meta.CustomProperties, rendered.meta.InternalProperties) {
+			continue
+		}
+		if event == nil {
+			event = newTailEvent(rendered, dp)
+		}
+		select {
+		case sub.events <- *event:
+		default:
+		}
+	}
+}
+
+func newTailEvent(rendered *renderedTimeSeries, dp queuedDatapoint) *TailEvent {
+	event := &TailEvent{
+		TSID:       dp.payload.TSID.String(),
+		Stream:     rendered.stream,
+		Dimensions: rendered.meta.CustomProperties,
+		Metrics:    make([]TailMetric, len(rendered.templates)),
+		Value:      strconv.FormatFloat(payloadValue(dp.payload), 'g', -1, 64),
+		Timestamp:  dp.timestamp,
+	}
+	for i, rt := range rendered.templates {
+		metric := TailMetric{Template: rt.template.ID()}
+		if rt.err != nil {
+			metric.Error = rt.err.Error()
+		} else {
+			metric.Name = rt.series.name
+			metric.Labels = make(map[string]string, len(rt.series.labelNames))
+			for j, labelName := range rt.series.labelNames {
+				metric.Labels[labelName] = rt.series.labelValues[j]
+			}
+		}
+		event.Metrics[i] = metric
+	}
+	return event
+}
+
+// parseTailRequest reads the filter and sampling rate of a tail request
+func parseTailRequest(r *http.Request) (*tailSubscriber, error) {
+	sub := &tailSubscriber{sampleRate: 1, events: make(chan TailEvent, tailBufferSize)}
+	query := r.URL.Query()
+	for _, match := range query["match"] {
+		matcher, err := config.ParseMatcher(match)
+		if err != nil {
+			return nil, err
+		}
+		sub.matchers = append(sub.matchers, matcher)
+	}
+	if sample := query.Get("sample"); sample != "" {
+		rate, err := strconv.ParseFloat(sample, 64)
+		if err != nil || rate <= 0 || rate > 1 {
+			return nil, fmt.Errorf("Invalid sample rate %s, expected a value in (0, 1]", sample)
+		}
+		sub.sampleRate = rate
+	}
+	return sub, nil
+}
+
+// tailHandler streams the datapoints of a flow as Server-Sent Events or
+// newline delimited JSON until the client disconnects
+func tailHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	flowStatuses.Lock()
+	status, ok := flowStatuses.flows[name]
+	flowStatuses.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown flow %s", name), http.StatusNotFound)
+		return
+	}
+	sub, err := parseTailRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sse := r.URL.Query().Get("format") == "sse" ||
+		(r.URL.Query().Get("format") == "" && strings.Contains(r.Header.Get("Accept"), "text/event-stream"))
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	status.tail.subscribe(sub)
+	defer status.tail.unsubscribe(sub)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-sub.events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("Failed to render tail event of flow %s - %+s\n", name, err)
+				continue
+			}
+			if sse {
+				_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+			} else {
+				_, err = fmt.Fprintf(w, "%s\n", data)
+			}
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package serve
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/signalfx/signalfx-go/idtool"
+	"github.com/signalfx/signalfx-go/signalflow/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTail(t *testing.T) {
+	cfg, fp := loadFlow(t, `---
+flows:
+- name: tail-flow
+  query: data('catchpoint.responsetime').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+    name: catchpoint_response_time
+    labels:
+      test: '{{ .SignalFxLabels.cp_testname }}'
+`)
+	status := statusOf(fp)
+	cache := newRenderCache(cfg, fp)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/debug/flows/{name}/tail", tailHandler)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/debug/flows/unknown/tail")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, err = http.Get(server.URL + "/debug/flows/tail-flow/tail?sample=2")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Get(server.URL + "/debug/flows/tail-flow/tail?match=cp_testname%3D~test-b.*")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	for atomic.LoadInt32(&status.tail.active) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	publish := func(tsid int64, testName string, value float64) {
+		meta := testMetadata(testName)
+		dp := queuedDatapoint{
+			payload:   messages.DataPayload{TSID: idtool.ID(tsid), Type: messages.ValTypeDouble},
+			timestamp: time.Unix(1600000000, 0).UTC(),
+		}
+		binary.BigEndian.PutUint64(dp.payload.Val[:], math.Float64bits(value))
+		status.tail.publish(cache.get(dp.payload.TSID, meta), dp)
+	}
+	publish(1, "test-a", 1)
+	publish(2, "test-b", 2.5)
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	assert.Nil(t, err)
+	var event TailEvent
+	assert.Nil(t, json.Unmarshal([]byte(line), &event))
+	assert.Equal(t, idtool.ID(2).String(), event.TSID)
+	assert.Equal(t, "default", event.Stream)
+	assert.Equal(t, "test-b", event.Dimensions["cp_testname"])
+	assert.Equal(t, "2.5", event.Value)
+	assert.Equal(t, time.Unix(1600000000, 0).UTC(), event.Timestamp)
+	assert.Equal(t, []TailMetric{{
+		Template: "tail-flow/0",
+		Name:     "catchpoint_response_time",
+		Labels:   map[string]string{"test": "test-b"},
+	}}, event.Metrics)
+}
+
+func TestTailServerSentEvents(t *testing.T) {
+	_, fp := loadFlow(t, `---
+flows:
+- name: tail-sse-flow
+  query: data('catchpoint.responsetime').publish()
+  prometheusMetricTemplates:
+  - type: gauge
+`)
+	statusOf(fp)
+	router := mux.NewRouter()
+	router.HandleFunc("/debug/flows/{name}/tail", tailHandler)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/debug/flows/tail-sse-flow/tail", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream"))
+}
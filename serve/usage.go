@@ -0,0 +1,164 @@
+package serve
+
+import (
+	"container/list"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// approximate memory held by a series besides its names and label values
+const (
+	seriesOverheadBytes = 400
+	valueBytes          = 16
+)
+
+// flowUsage tracks the series of a flow by their last update and the
+// approximate memory they hold
+type flowUsage struct {
+	bytes   int64
+	evicted int
+	budget  int64
+	// least recently updated series at the back
+	lru *list.List
+	// rendered time series of the flow, dropped along with evicted series
+	cache *renderCache
+}
+
+// usage returns the usage of a flow, creating it on first use. Must be called
+// with the lock held.
+func (s *seriesStore) usage(flow string) *flowUsage {
+	fu, ok := s.flows[flow]
+	if !ok {
+		fu = &flowUsage{lru: list.New()}
+		s.flows[flow] = fu
+	}
+	return fu
+}
+
+// seriesBytes approximates the memory held by a new series
+func seriesBytes(meta seriesMetadata, key string) int64 {
+	size := seriesOverheadBytes + len(meta.name) + len(meta.help) + len(key)
+	for i := range meta.labelNames {
+		size += len(meta.labelNames[i]) + len(meta.labelValues[i])
+	}
+	return int64(size)
+}
+
+// track adds a new series to the usage of its flow and evicts the least
+// recently updated series of the flow when it exceeds its memory budget.
+// Must be called with the lock held.
+func (s *seriesStore) track(ser *series) {
+	fu := s.usage(ser.owner.flow)
+	ser.lruElement = fu.lru.PushFront(ser)
+	fu.bytes += ser.bytes
+	fu.budget = ser.owner.flowMemoryBudget
+	s.enforceBudget(fu)
+}
+
+// enforceBudget evicts the least recently updated series of a flow while it
+// exceeds its memory budget. The most recently updated series is kept. Must be
+// called with the lock held.
+func (s *seriesStore) enforceBudget(fu *flowUsage) {
+	for fu.budget > 0 && fu.bytes > fu.budget && fu.lru.Len() > 1 {
+		s.evict(fu.lru.Back().Value.(*series))
+		fu.evicted++
+	}
+}
+
+// setRenderCache registers the render cache of a flow, so the cached time
+// series of evicted series don't hold memory beyond the budget
+func (s *seriesStore) setRenderCache(flow string, cache *renderCache) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.usage(flow).cache = cache
+}
+
+// touch marks a series as recently updated. Must be called with the lock held.
+func (s *seriesStore) touch(ser *series) {
+	s.flows[ser.owner.flow].lru.MoveToFront(ser.lruElement)
+}
+
+// grow accounts additional memory held by a series. Must be called with the
+// lock held.
+func (s *seriesStore) grow(ser *series, bytes int64) {
+	ser.bytes += bytes
+	fu := s.flows[ser.owner.flow]
+	fu.bytes += bytes
+	if bytes > 0 {
+		s.enforceBudget(fu)
+	}
+}
+
+// evict removes a series from the store. Must be called with the lock held.
+func (s *seriesStore) evict(ser *series) {
+	fu := s.flows[ser.owner.flow]
+	fu.lru.Remove(ser.lruElement)
+	fu.bytes -= ser.bytes
+	family := s.families[ser.family]
+	delete(family.series, ser.key)
+	if len(family.series) == 0 {
+		delete(s.families, ser.family)
+	}
+	s.counts.remove(ser.owner)
+	if fu.cache != nil {
+		for tsid := range ser.sources {
+			fu.cache.expire(tsid)
+		}
+	}
+}
+
+// clearFlow removes all series of a flow from the store and returns how many
+// were removed
+func (s *seriesStore) clearFlow(flow string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fu, ok := s.flows[flow]
+	if !ok {
+		return 0
+	}
+	cleared := fu.lru.Len()
+	for fu.lru.Len() > 0 {
+		s.evict(fu.lru.Back().Value.(*series))
+	}
+	return cleared
+}
+
+// usageCollector exposes the series count and memory usage of the store per
+// flow as self observability metrics
+type usageCollector struct {
+	store       *seriesStore
+	seriesDesc  *prometheus.Desc
+	bytesDesc   *prometheus.Desc
+	evictedDesc *prometheus.Desc
+}
+
+func newUsageCollector(store *seriesStore) *usageCollector {
+	return &usageCollector{
+		store: store,
+		seriesDesc: prometheus.NewDesc(
+			"sfxpe_flow_series", "Number of series held by the store", []string{"flow"}, nil,
+		),
+		bytesDesc: prometheus.NewDesc(
+			"sfxpe_flow_series_bytes", "Approximate memory held by the series of the store", []string{"flow"}, nil,
+		),
+		evictedDesc: prometheus.NewDesc(
+			"sfxpe_flow_series_evicted_total", "Number of series evicted to stay within the memory budget", []string{"flow"}, nil,
+		),
+	}
+}
+
+func (uc *usageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- uc.seriesDesc
+	ch <- uc.bytesDesc
+	ch <- uc.evictedDesc
+}
+
+func (uc *usageCollector) Collect(ch chan<- prometheus.Metric) {
+	uc.store.mu.Lock()
+	defer uc.store.mu.Unlock()
+	for flow, fu := range uc.store.flows {
+		ch <- prometheus.MustNewConstMetric(uc.seriesDesc, prometheus.GaugeValue, float64(fu.lru.Len()), flow)
+		ch <- prometheus.MustNewConstMetric(uc.bytesDesc, prometheus.GaugeValue, float64(fu.bytes), flow)
+		ch <- prometheus.MustNewConstMetric(uc.evictedDesc, prometheus.CounterValue, float64(fu.evicted), flow)
+	}
+}
@@ -0,0 +1,98 @@
+package serve
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/signalfx/signalfx-go/idtool"
+	"github.com/signalfx/signalfx-go/signalflow/messages"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreMemoryBudget(t *testing.T) {
+	store := newSeriesStore()
+	gauge := func(instance string) seriesMetadata {
+		return seriesMetadata{
+			name:        "some_gauge",
+			labelNames:  []string{"instance"},
+			labelValues: []string{instance},
+			owner:       seriesOwner{flow: "flow-a", template: "flow-a/0", flowMemoryBudget: 2*seriesOverheadBytes + 100},
+		}
+	}
+	assert.Nil(t, store.setGauge(gauge("a"), 1))
+	assert.Nil(t, store.setGauge(gauge("b"), 1))
+	assert.Equal(t, 2, store.flows["flow-a"].lru.Len())
+
+	// a is updated more recently than b, so b is evicted for c
+	assert.Nil(t, store.setGauge(gauge("a"), 2))
+	assert.Nil(t, store.setGauge(gauge("c"), 1))
+	usage := store.flows["flow-a"]
+	assert.Equal(t, 1, usage.evicted)
+	assert.Equal(t, 2, usage.lru.Len())
+	assert.LessOrEqual(t, usage.bytes, int64(2*seriesOverheadBytes+100))
+
+	instances := []string{}
+	for _, m := range gatherStore(t, store)["some_gauge"].Metric {
+		instances = append(instances, m.Label[0].GetValue())
+	}
+	assert.ElementsMatch(t, []string{"a", "c"}, instances)
+	assert.Equal(t, 2, store.counts.byFlow["flow-a"])
+
+	// series of other flows are not affected by the budget
+	other := seriesMetadata{name: "other_gauge", owner: seriesOwner{flow: "flow-b", template: "flow-b/0"}}
+	assert.Nil(t, store.setGauge(other, 1))
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newUsageCollector(store))
+	count, err := testutil.GatherAndCount(registry, "sfxpe_flow_series", "sfxpe_flow_series_bytes", "sfxpe_flow_series_evicted_total")
+	assert.Nil(t, err)
+	assert.Equal(t, 6, count)
+	assert.Greater(t, store.flows["flow-b"].bytes, int64(seriesOverheadBytes))
+}
+
+func TestStoreMemoryBudgetSources(t *testing.T) {
+	cfg, fp := loadFlow(t, `---
+flows:
+- name: budget-flow
+  query: data('catchpoint.responsetime').publish()
+  memoryBudget: 2000
+  prometheusMetricTemplates:
+  - type: gauge
+    name: catchpoint_response_time
+    labels:
+      instance: '{{ .SignalFxLabels.cp_testname }}'
+`)
+	cache := newRenderCache(cfg, fp)
+	store := newSeriesStore()
+	store.setRenderCache(fp.Name, cache)
+	apply := func(tsid int64, meta *messages.MetadataProperties) {
+		rendered := cache.get(idtool.ID(tsid), meta)
+		assert.Nil(t, store.setGauge(rendered.templates[0].series, 1))
+	}
+
+	apply(1, testMetadata("test-a"))
+	apply(2, testMetadata("test-b"))
+	usage := store.flows[fp.Name]
+	assert.Equal(t, 2, usage.lru.Len())
+	bytes := usage.bytes
+
+	// sources of short-lived time series grow the most recent series until
+	// the least recently updated one is evicted, along with its cached render
+	tsid := int64(3)
+	for ; usage.evicted == 0; tsid++ {
+		apply(tsid, testMetadata("test-b"))
+	}
+	assert.Equal(t, 1, usage.lru.Len())
+	assert.LessOrEqual(t, usage.bytes, int64(fp.MemoryBudget))
+	_, cached := cache.entries[idtool.ID(1)]
+	assert.False(t, cached)
+
+	// expired time series are removed from the sources of their series
+	for expired := int64(2); expired < tsid; expired++ {
+		if rendered := cache.expire(idtool.ID(expired)); rendered != nil {
+			store.removeSources(idtool.ID(expired), rendered)
+		}
+	}
+	assert.Less(t, usage.bytes, bytes)
+}
@@ -0,0 +1,198 @@
+package web
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the web configuration of a server. The format is compatible with
+// the web-config.yml of the Prometheus exporter-toolkit and adds bearer
+// token authentication.
+type Config struct {
+	TLSConfig    TLSConfig         `yaml:"tls_server_config"`
+	HTTPConfig   HTTPConfig        `yaml:"http_server_config"`
+	Users        map[string]string `yaml:"basic_auth_users"`
+	BearerTokens []string          `yaml:"bearer_tokens"`
+}
+
+type TLSConfig struct {
+	CertFile                 string   `yaml:"cert_file"`
+	KeyFile                  string   `yaml:"key_file"`
+	ClientAuth               string   `yaml:"client_auth_type"`
+	ClientCAs                string   `yaml:"client_ca_file"`
+	MinVersion               string   `yaml:"min_version"`
+	MaxVersion               string   `yaml:"max_version"`
+	CipherSuites             []string `yaml:"cipher_suites"`
+	CurvePreferences         []string `yaml:"curve_preferences"`
+	PreferServerCipherSuites *bool    `yaml:"prefer_server_cipher_suites"`
+}
+
+type HTTPConfig struct {
+	HTTP2   *bool             `yaml:"http2"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+var (
+	tlsVersions = map[string]uint16{
+		"TLS10": tls.VersionTLS10,
+		"TLS11": tls.VersionTLS11,
+		"TLS12": tls.VersionTLS12,
+		"TLS13": tls.VersionTLS13,
+	}
+
+	curves = map[string]tls.CurveID{
+		"CurveP256": tls.CurveP256,
+		"CurveP384": tls.CurveP384,
+		"CurveP521": tls.CurveP521,
+		"X25519":    tls.X25519,
+	}
+
+	clientAuthTypes = map[string]tls.ClientAuthType{
+		"":                           tls.NoClientCert,
+		"NoClientCert":               tls.NoClientCert,
+		"RequestClientCert":          tls.RequestClientCert,
+		"RequireAnyClientCert":       tls.RequireAnyClientCert,
+		"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+		"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+	}
+)
+
+// LoadConfig reads a web config file. Relative file paths in the config are
+// resolved against the directory of the config file.
+func LoadConfig(file string) (*Config, error) {
+	configBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	decoder := yaml.NewDecoder(bytes.NewReader(configBytes))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("Invalid web config %s - %+s", file, err)
+	}
+	dir := filepath.Dir(file)
+	for _, path := range []*string{&cfg.TLSConfig.CertFile, &cfg.TLSConfig.KeyFile, &cfg.TLSConfig.ClientCAs} {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(dir, *path)
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (c *Config) Validate() error {
+	tc := c.TLSConfig
+	if (tc.CertFile == "") != (tc.KeyFile == "") {
+		return fmt.Errorf("TLS requires both cert_file and key_file")
+	}
+	if tc.CertFile == "" && (tc.ClientCAs != "" || tc.ClientAuth != "") {
+		return fmt.Errorf("Client authentication requires cert_file and key_file")
+	}
+	if _, ok := clientAuthTypes[tc.ClientAuth]; !ok {
+		return fmt.Errorf("Invalid client_auth_type %s", tc.ClientAuth)
+	}
+	if tc.ClientCAs != "" && clientAuthTypes[tc.ClientAuth] == tls.NoClientCert {
+		return fmt.Errorf("client_ca_file requires a client_auth_type")
+	}
+	// without client CAs, Go verifies client certificates against the system
+	// roots and accepts any certificate of a public CA
+	switch clientAuthTypes[tc.ClientAuth] {
+	case tls.VerifyClientCertIfGiven, tls.RequireAndVerifyClientCert:
+		if tc.ClientCAs == "" {
+			return fmt.Errorf("client_auth_type %s requires a client_ca_file", tc.ClientAuth)
+		}
+	}
+	for _, version := range []string{tc.MinVersion, tc.MaxVersion} {
+		if _, ok := tlsVersions[version]; version != "" && !ok {
+			return fmt.Errorf("Unknown TLS version %s", version)
+		}
+	}
+	for _, name := range tc.CipherSuites {
+		if _, ok := cipherSuiteID(name); !ok {
+			return fmt.Errorf("Unknown cipher suite %s", name)
+		}
+	}
+	for _, name := range tc.CurvePreferences {
+		if _, ok := curves[name]; !ok {
+			return fmt.Errorf("Unknown curve %s", name)
+		}
+	}
+	for _, token := range c.BearerTokens {
+		if token == "" {
+			return fmt.Errorf("Bearer tokens must not be empty")
+		}
+	}
+	return nil
+}
+
+// cipherSuiteID returns the ID of a cipher suite by its name, e.g.
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, suite := range suites {
+			if suite.Name == name {
+				return suite.ID, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// TLSEnabled reports whether the server serves HTTPS
+func (c *Config) TLSEnabled() bool {
+	return c.TLSConfig.CertFile != ""
+}
+
+// AuthEnabled reports whether requests must authenticate
+func (c *Config) AuthEnabled() bool {
+	return len(c.Users) > 0 || len(c.BearerTokens) > 0
+}
+
+// tlsConfig loads the certificates of the config into a TLS config
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	tc := c.TLSConfig
+	cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load TLS certificate - %+s", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		ClientAuth:   clientAuthTypes[tc.ClientAuth],
+	}
+	if tc.MinVersion != "" {
+		cfg.MinVersion = tlsVersions[tc.MinVersion]
+	}
+	if tc.MaxVersion != "" {
+		cfg.MaxVersion = tlsVersions[tc.MaxVersion]
+	}
+	// cipher suites only apply to TLS 1.2 and below, Go picks TLS 1.3 suites
+	for _, name := range tc.CipherSuites {
+		id, _ := cipherSuiteID(name)
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+	for _, name := range tc.CurvePreferences {
+		cfg.CurvePreferences = append(cfg.CurvePreferences, curves[name])
+	}
+	cfg.PreferServerCipherSuites = tc.PreferServerCipherSuites == nil || *tc.PreferServerCipherSuites
+	if tc.ClientCAs != "" {
+		caBytes, err := ioutil.ReadFile(tc.ClientCAs)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("No certificates found in client_ca_file %s", tc.ClientCAs)
+		}
+		cfg.ClientCAs = pool
+	}
+	return cfg, nil
+}
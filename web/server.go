@@ -0,0 +1,235 @@
+package web
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// errTLSDisabled fails handshakes of a TLS server whose web config no longer
+// enables TLS, switching protocols requires a restart
+var errTLSDisabled = errors.New("TLS is not enabled in the web config")
+
+// dummyHash is compared against the password of unknown users, so that the
+// response time doesn't tell which users exist
+const dummyHash = "$2y$10$QOauhQNbBCuQDKes6eFzPeMqBSjb7Mr5DUmpZ/VcEd00UAV/LDeSi"
+
+// compareHashAndPassword is replaced in tests to observe the bcrypt checks
+var compareHashAndPassword = bcrypt.CompareHashAndPassword
+
+// authenticatedKey marks requests in their context that passed authentication
+type authenticatedKey struct{}
+
+// reloader holds the web config of a server and loads it again when the
+// config file or one of the certificate files it references changed
+type reloader struct {
+	file      string
+	mu        sync.Mutex
+	modTimes  map[string]time.Time
+	config    *Config
+	tlsConfig *tls.Config
+	// successful basic auth checks, bcrypt is too slow to run on every request
+	authCache map[string]bool
+}
+
+func newReloader(file string) (*reloader, error) {
+	r := &reloader{file: file}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *reloader) load() error {
+	cfg, err := LoadConfig(r.file)
+	if err != nil {
+		return err
+	}
+	var tlsConfig *tls.Config
+	if cfg.TLSEnabled() {
+		if tlsConfig, err = cfg.tlsConfig(); err != nil {
+			return err
+		}
+	}
+	r.config = cfg
+	r.tlsConfig = tlsConfig
+	r.modTimes = r.fileModTimes(cfg)
+	r.authCache = make(map[string]bool)
+	return nil
+}
+
+func (r *reloader) fileModTimes(cfg *Config) map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, file := range []string{r.file, cfg.TLSConfig.CertFile, cfg.TLSConfig.KeyFile, cfg.TLSConfig.ClientCAs} {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			modTimes[file] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// current returns the current web config and reloads it if needed. A config
+// that fails to load is logged and the previous config stays in use.
+func (r *reloader) current() (*Config, *tls.Config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	modTimes := r.fileModTimes(r.config)
+	changed := len(modTimes) != len(r.modTimes)
+	for file, modTime := range modTimes {
+		if !r.modTimes[file].Equal(modTime) {
+			changed = true
+		}
+	}
+	if changed {
+		if err := r.load(); err != nil {
+			log.Printf("Failed to reload web config %s - %+s\n", r.file, err)
+			r.modTimes = modTimes
+		}
+	}
+	return r.config, r.tlsConfig
+}
+
+func (r *reloader) checkBasicAuth(cfg *Config, user string, password string) bool {
+	hashed, ok := cfg.Users[user]
+	if !ok {
+		compareHashAndPassword([]byte(dummyHash), []byte(password))
+		return false
+	}
+	sum := sha256.Sum256([]byte(user + "\x00" + hashed + "\x00" + password))
+	cacheKey := hex.EncodeToString(sum[:])
+	r.mu.Lock()
+	cached := r.authCache[cacheKey]
+	r.mu.Unlock()
+	if cached {
+		return true
+	}
+	if compareHashAndPassword([]byte(hashed), []byte(password)) != nil {
+		return false
+	}
+	r.mu.Lock()
+	r.authCache[cacheKey] = true
+	r.mu.Unlock()
+	return true
+}
+
+func checkBearerToken(cfg *Config, token string) bool {
+	valid := false
+	for _, expected := range cfg.BearerTokens {
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// authenticate reports whether a request may be served
+func (r *reloader) authenticate(cfg *Config, req *http.Request) bool {
+	if !cfg.AuthEnabled() {
+		return true
+	}
+	if user, password, ok := req.BasicAuth(); ok {
+		return r.checkBasicAuth(cfg, user, password)
+	}
+	authorization := req.Header.Get("Authorization")
+	if strings.HasPrefix(authorization, "Bearer ") {
+		return checkBearerToken(cfg, strings.TrimPrefix(authorization, "Bearer "))
+	}
+	return false
+}
+
+// handler wraps a handler with the authentication and response headers of
+// the web config. Requests to the public paths are served without
+// authentication.
+func (r *reloader) handler(next http.Handler, publicPaths []string) http.Handler {
+	public := make(map[string]bool, len(publicPaths))
+	for _, path := range publicPaths {
+		public[path] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		cfg, _ := r.current()
+		for name, value := range cfg.HTTPConfig.Headers {
+			w.Header().Set(name, value)
+		}
+		if !public[req.URL.Path] && !r.authenticate(cfg, req) {
+			if len(cfg.Users) > 0 {
+				w.Header().Set("WWW-Authenticate", "Basic")
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if !public[req.URL.Path] && cfg.AuthEnabled() {
+			req = req.WithContext(context.WithValue(req.Context(), authenticatedKey{}, true))
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// RequireAuthentication wraps a handler that must only serve authenticated
+// requests. Requests are rejected when the web config of the server doesn't
+// enable authentication, e.g. after it was reloaded without users or tokens.
+func RequireAuthentication(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if authenticated, _ := req.Context().Value(authenticatedKey{}).(bool); !authenticated {
+			http.Error(w, "Authentication is required but not enabled in the web config", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// ListenAndServe starts a server secured by the web config file. Without a
+// web config file the server serves plain HTTP without authentication.
+func ListenAndServe(server *http.Server, webConfigFile string, publicPaths ...string) error {
+	if webConfigFile == "" {
+		return server.ListenAndServe()
+	}
+	r, err := newReloader(webConfigFile)
+	if err != nil {
+		return err
+	}
+	server.Handler = r.handler(server.Handler, publicPaths)
+	cfg, _ := r.current()
+	if !cfg.TLSEnabled() {
+		return server.ListenAndServe()
+	}
+	nextProtos := []string{"h2", "http/1.1"}
+	if cfg.HTTPConfig.HTTP2 != nil && !*cfg.HTTPConfig.HTTP2 {
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		nextProtos = []string{"http/1.1"}
+	}
+	// certificates are loaded again for new connections when their files
+	// changed, so renewed certificates are used without a restart
+	server.TLSConfig = &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			_, tlsConfig := r.current()
+			if tlsConfig == nil {
+				return nil, errTLSDisabled
+			}
+			return &tlsConfig.Certificates[0], nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			_, tlsConfig := r.current()
+			if tlsConfig == nil {
+				return nil, errTLSDisabled
+			}
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.NextProtos = nextProtos
+			return tlsConfig, nil
+		},
+	}
+	return server.ListenAndServeTLS("", "")
+}
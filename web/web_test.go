@@ -0,0 +1,225 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeFile(t *testing.T, dir string, name string, content string) string {
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+// writeCertificate writes a self signed certificate and its key
+func writeCertificate(t *testing.T, dir string, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	writeFile(t, dir, "tls.crt", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	writeFile(t, dir, "tls.key", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})))
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := writeFile(t, dir, "web-config.yml", `
+tls_server_config:
+  cert_file: tls.crt
+  key_file: /etc/tls/tls.key
+  min_version: TLS13
+basic_auth_users:
+  alice: $2y$10$abc
+`)
+	cfg, err := LoadConfig(file)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "tls.crt"), cfg.TLSConfig.CertFile)
+	assert.Equal(t, "/etc/tls/tls.key", cfg.TLSConfig.KeyFile)
+	assert.True(t, cfg.TLSEnabled())
+	assert.True(t, cfg.AuthEnabled())
+
+	_, err = LoadConfig(writeFile(t, dir, "client-auth.yml", `
+tls_server_config:
+  cert_file: tls.crt
+  key_file: tls.key
+  client_auth_type: RequireAndVerifyClientCert
+  client_ca_file: ca.crt
+`))
+	assert.Nil(t, err)
+
+	for _, invalid := range []string{
+		"tls_server_config:\n  cert_file: tls.crt\n",
+		"tls_server_config:\n  cert_file: tls.crt\n  key_file: tls.key\n  min_version: SSL3\n",
+		"tls_server_config:\n  cert_file: tls.crt\n  key_file: tls.key\n  client_ca_file: ca.crt\n",
+		"tls_server_config:\n  cert_file: tls.crt\n  key_file: tls.key\n  client_auth_type: RequireAndVerifyClientCert\n",
+		"tls_server_config:\n  cert_file: tls.crt\n  key_file: tls.key\n  client_auth_type: VerifyClientCertIfGiven\n",
+		"unknown_field: true\n",
+		"bearer_tokens: ['']\n",
+	} {
+		_, err := LoadConfig(writeFile(t, dir, "invalid.yml", invalid))
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestLoadExporterToolkitTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeCertificate(t, dir, "localhost")
+	cfg, err := LoadConfig(writeFile(t, dir, "web-config.yml", `
+tls_server_config:
+  cert_file: tls.crt
+  key_file: tls.key
+  cipher_suites:
+  - TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+  - TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384
+  curve_preferences: [X25519, CurveP256]
+  prefer_server_cipher_suites: false
+`))
+	assert.Nil(t, err)
+	tlsConfig, err := cfg.tlsConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}, tlsConfig.CipherSuites)
+	assert.Equal(t, []tls.CurveID{tls.X25519, tls.CurveP256}, tlsConfig.CurvePreferences)
+
+	for _, invalid := range []string{
+		"tls_server_config:\n  cert_file: tls.crt\n  key_file: tls.key\n  cipher_suites: [TLS_UNKNOWN]\n",
+		"tls_server_config:\n  cert_file: tls.crt\n  key_file: tls.key\n  curve_preferences: [CurveP224]\n",
+	} {
+		_, err := LoadConfig(writeFile(t, dir, "invalid.yml", invalid))
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.Nil(t, err)
+	file := writeFile(t, t.TempDir(), "web-config.yml", `
+basic_auth_users:
+  alice: `+string(hashed)+`
+bearer_tokens:
+- token-1
+http_server_config:
+  headers:
+    X-Frame-Options: deny
+`)
+	r, err := newReloader(file)
+	assert.Nil(t, err)
+	handler := r.handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), []string{"/healthy"})
+
+	serve := func(path string, auth func(req *http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		auth(req)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	noAuth := func(req *http.Request) {}
+
+	w := serve("/metrics", noAuth)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "Basic", w.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, "deny", w.Header().Get("X-Frame-Options"))
+	assert.Equal(t, http.StatusOK, serve("/healthy", noAuth).Code)
+
+	for i := 0; i < 2; i++ {
+		// the second request is served from the auth cache
+		w = serve("/metrics", func(req *http.Request) { req.SetBasicAuth("alice", "secret") })
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	w = serve("/metrics", func(req *http.Request) { req.SetBasicAuth("alice", "wrong") })
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// unknown users pay for a bcrypt check like known users
+	var compared [][]byte
+	compareHashAndPassword = func(hashed []byte, password []byte) error {
+		compared = append(compared, hashed)
+		return bcrypt.CompareHashAndPassword(hashed, password)
+	}
+	defer func() { compareHashAndPassword = bcrypt.CompareHashAndPassword }()
+	w = serve("/metrics", func(req *http.Request) { req.SetBasicAuth("bob", "secret") })
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, [][]byte{[]byte(dummyHash)}, compared)
+	assert.Equal(t, bcrypt.ErrMismatchedHashAndPassword, bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte("secret")))
+
+	w = serve("/metrics", func(req *http.Request) { req.Header.Set("Authorization", "Bearer token-1") })
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serve("/metrics", func(req *http.Request) { req.Header.Set("Authorization", "Bearer token-2") })
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestRequireAuthentication(t *testing.T) {
+	protected := RequireAuthentication(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(webConfig string, auth func(req *http.Request)) int {
+		r, err := newReloader(writeFile(t, t.TempDir(), "web-config.yml", webConfig))
+		assert.Nil(t, err)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/admin/flows/a/pause", nil)
+		auth(req)
+		w := httptest.NewRecorder()
+		r.handler(protected, nil).ServeHTTP(w, req)
+		return w.Code
+	}
+
+	withToken := func(req *http.Request) { req.Header.Set("Authorization", "Bearer token-1") }
+	assert.Equal(t, http.StatusOK, serve("bearer_tokens: [token-1]\n", withToken))
+	assert.Equal(t, http.StatusUnauthorized, serve("bearer_tokens: [token-1]\n", func(req *http.Request) {}))
+	assert.Equal(t, http.StatusForbidden, serve("http_server_config: {}\n", withToken))
+
+	// requests that bypassed the web config are never authenticated
+	w := httptest.NewRecorder()
+	protected.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/admin/flows/a/pause", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestReloadCertificates(t *testing.T) {
+	dir := t.TempDir()
+	writeCertificate(t, dir, "first")
+	file := writeFile(t, dir, "web-config.yml", "tls_server_config:\n  cert_file: tls.crt\n  key_file: tls.key\n")
+	r, err := newReloader(file)
+	assert.Nil(t, err)
+
+	commonName := func() string {
+		_, tlsConfig := r.current()
+		cert, err := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+		assert.Nil(t, err)
+		return cert.Subject.CommonName
+	}
+	assert.Equal(t, "first", commonName())
+
+	writeCertificate(t, dir, "second")
+	future := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(filepath.Join(dir, "tls.crt"), future, future))
+	assert.Equal(t, "second", commonName())
+
+	// broken files keep the previous certificate in use
+	writeFile(t, dir, "tls.crt", "invalid")
+	future = future.Add(time.Minute)
+	assert.Nil(t, os.Chtimes(filepath.Join(dir, "tls.crt"), future, future))
+	assert.Equal(t, "second", commonName())
+}